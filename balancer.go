@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+const (
+	defaultBalanceThreshold = 0.1
+	defaultBalanceBandwidth = 10 << 20
+)
+
+// ReplicaInfo describes a replica a node holds for another node. The replica
+// is a shard if Stripe is set, to the key of its stripe.
+type ReplicaInfo struct {
+	Owner  string
+	Key    string
+	Size   int64
+	Stripe string
+}
+
+// MessageGetUsage asks a node how much it stores.
+type MessageGetUsage struct{}
+
+// MessageUsage answers a MessageGetUsage. Used counts every object on disk,
+// Replicas lists the ones held for other nodes, which are the ones that can
+// be moved.
+type MessageUsage struct {
+	Used     int64
+	Replicas []ReplicaInfo
+	Err      string
+}
+
+// nodeUsage is the usage reported by a node.
+type nodeUsage struct {
+	ID string
+	MessageUsage
+}
+
+// Move moves the replica of the Owner's Key from Source to Target.
+type Move struct {
+	ReplicaInfo
+	Source string
+	Target string
+}
+
+// BalanceReport sums up a run of the balancer.
+type BalanceReport struct {
+	Planned int
+	Moved   int
+	Bytes   int64
+}
+
+// usage returns what the local store holds.
+func (s *FileServer) usage() (MessageUsage, error) {
+	usage := MessageUsage{}
+
+	ids, err := s.store.IDs()
+	if err != nil {
+		return usage, err
+	}
+
+	for _, id := range ids {
+		metas, err := s.store.Metas(id)
+		if err != nil {
+			return usage, err
+		}
+
+		for _, meta := range metas {
+			usage.Used += meta.Size
+			if id == s.ID {
+				continue
+			}
+			r := ReplicaInfo{Owner: id, Key: meta.Key, Size: meta.Size}
+			if meta.Stripe != nil {
+				r.Stripe = meta.Stripe.Key
+			}
+			usage.Replicas = append(usage.Replicas, r)
+		}
+	}
+
+	return usage, nil
+}
+
+// clusterUsage collects the usage of ourselves and of every peer that answers
+// within RequestTimeout. Decommissioning nodes are left out, they move their
+// data away on their own.
+func (s *FileServer) clusterUsage() ([]nodeUsage, error) {
+	own, err := s.usage()
+	if err != nil {
+		return nil, err
+	}
+	nodes := []nodeUsage{{ID: s.ID, MessageUsage: own}}
+
+	s.peerLock.Lock()
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for id, peer := range s.peers {
+		if !s.members.decommissioning(id) {
+			peers = append(peers, peer)
+		}
+	}
+	s.peerLock.Unlock()
+
+	id, replies := s.pending.add(len(peers))
+	defer s.pending.remove(id)
+
+	sent := 0
+	for _, peer := range peers {
+		if err := s.send(peer, &Message{RequestID: id, Payload: MessageGetUsage{}}); err != nil {
+			log.Printf("[%s] asking %s for its usage failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+			continue
+		}
+		sent++
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	for ; sent > 0; sent-- {
+		r, err := s.pending.wait(ctx, replies)
+		if err != nil {
+			log.Printf("[%s] gave up waiting for %d usage reports: %s", s.Transport.Addr(), sent, err)
+			break
+		}
+
+		usage := r.msg.Payload.(MessageUsage)
+		if len(usage.Err) > 0 {
+			log.Printf("[%s] %s failed to report its usage: %s", s.Transport.Addr(), r.from, usage.Err)
+			continue
+		}
+		nodes = append(nodes, nodeUsage{ID: r.from, MessageUsage: usage})
+	}
+
+	return nodes, nil
+}
+
+// planMoves plans the replica moves that bring the usage of every node down to
+// at most 1+threshold times the mean usage. Replicas move from the fullest
+// nodes to the emptiest ones, never to their owner or to a node that holds
+// them already, and never fill a node past the mean. A shard never moves to a
+// node holding another shard of its stripe. Targets are spread across failure
+// domains, as topology tells them, away from the owner and the other holders,
+// and a replica is left where it is rather than moved to a node that shares
+// more failure domains with them.
+func planMoves(nodes []nodeUsage, threshold float64, topology func(id string) Topology) []Move {
+	if len(nodes) < 2 {
+		return nil
+	}
+
+	var total int64
+	used := make(map[string]int64, len(nodes))
+	holders := make(map[string][]string)
+	// The holders of the shards of every stripe, once for every shard.
+	stripes := make(map[string][]string)
+	for _, n := range nodes {
+		total += n.Used
+		used[n.ID] = n.Used
+		for _, r := range n.Replicas {
+			k := metadataKey(r.Owner, r.Key)
+			holders[k] = append(holders[k], n.ID)
+			if len(r.Stripe) > 0 {
+				sk := metadataKey(r.Owner, r.Stripe)
+				stripes[sk] = append(stripes[sk], n.ID)
+			}
+		}
+	}
+	mean := float64(total) / float64(len(nodes))
+	limit := int64(mean * (1 + threshold))
+
+	sources := make([]nodeUsage, len(nodes))
+	copy(sources, nodes)
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Used > sources[j].Used })
+
+	moves := []Move{}
+	for _, src := range sources {
+		replicas := make([]ReplicaInfo, len(src.Replicas))
+		copy(replicas, src.Replicas)
+		sort.Slice(replicas, func(i, j int) bool { return replicas[i].Size > replicas[j].Size })
+
+		for _, r := range replicas {
+			if used[src.ID] <= limit {
+				break
+			}
+
+			k := metadataKey(r.Owner, r.Key)
+			sk := metadataKey(r.Owner, r.Stripe)
+			candidates := []string{}
+			for _, n := range nodes {
+				if n.ID == src.ID || n.ID == r.Owner || slices.Contains(holders[k], n.ID) {
+					continue
+				}
+				if len(r.Stripe) > 0 && slices.Contains(stripes[sk], n.ID) {
+					continue
+				}
+				if float64(used[n.ID]+r.Size) > mean {
+					continue
+				}
+				candidates = append(candidates, n.ID)
+			}
+			sort.SliceStable(candidates, func(i, j int) bool { return used[candidates[i]] < used[candidates[j]] })
+
+			// The owner and the holders that keep their replica, or the
+			// other shards of the stripe.
+			placed := []string{r.Owner}
+			for _, id := range holders[k] {
+				if id != src.ID {
+					placed = append(placed, id)
+				}
+			}
+			if len(r.Stripe) > 0 {
+				placed = append(placed, slices.DeleteFunc(slices.Clone(stripes[sk]), func(id string) bool { return id == src.ID })...)
+			}
+
+			picked := spread(candidates, placed, topology, 1)
+			if len(picked) == 0 {
+				continue
+			}
+			target := picked[0]
+			before := failureDomains(append(placed, src.ID), topology)
+			after := failureDomains(append(placed, target), topology)
+			if after.less(before) {
+				continue
+			}
+
+			moves = append(moves, Move{ReplicaInfo: r, Source: src.ID, Target: target})
+			used[src.ID] -= r.Size
+			used[target] += r.Size
+			holders[k] = append(slices.DeleteFunc(holders[k], func(id string) bool { return id == src.ID }), target)
+			if len(r.Stripe) > 0 {
+				i := slices.Index(stripes[sk], src.ID)
+				stripes[sk] = append(slices.Delete(stripes[sk], i, i+1), target)
+			}
+		}
+	}
+
+	return moves
+}
+
+// domainCount is the number of distinct zones, racks and hosts some nodes
+// span.
+type domainCount [3]int
+
+func failureDomains(ids []string, topology func(id string) Topology) domainCount {
+	zones := make(map[string]bool)
+	racks := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for _, id := range ids {
+		t := topology(id)
+		zones[t.Zone] = true
+		racks[t.Zone+"/"+t.Rack] = true
+		hosts[t.Zone+"/"+t.Rack+"/"+t.Host] = true
+	}
+	return domainCount{len(zones), len(racks), len(hosts)}
+}
+
+// less reports whether c spans fewer domains than other, zones weighing more
+// than racks and racks more than hosts.
+func (c domainCount) less(other domainCount) bool {
+	for i := range c {
+		if c[i] != other[i] {
+			return c[i] < other[i]
+		}
+	}
+	return false
+}
+
+// Balance evens out the disk usage of the cluster: it collects the usage of
+// every node, plans the replica moves that bring every node within
+// BalanceThreshold above the mean and carries them out one after the other,
+// at most BalanceBandwidth bytes per second. Only the metadata node balances,
+// as it has to keep track of the moved replicas.
+func (s *FileServer) Balance() (BalanceReport, error) {
+	report := BalanceReport{}
+	if !s.MetadataNode {
+		return report, errors.New("only the metadata node can balance the cluster")
+	}
+
+	nodes, err := s.clusterUsage()
+	if err != nil {
+		return report, err
+	}
+
+	moves := planMoves(nodes, s.BalanceThreshold, s.topology)
+	report.Planned = len(moves)
+
+	for _, m := range moves {
+		msg := MessageReplicate{
+			Owner:     m.Owner,
+			Key:       m.Key,
+			Target:    m.Target,
+			Bandwidth: s.BalanceBandwidth,
+			Move:      true,
+		}
+
+		timeout := 2*s.RequestTimeout + time.Duration(m.Size/s.BalanceBandwidth+1)*time.Second
+		if err := s.transferReplicaFrom(m.Source, msg, timeout); err != nil {
+			log.Printf("[%s] moving (%s) from %s to %s failed: %s", s.Transport.Addr(), m.Key, m.Source, m.Target, err)
+			continue
+		}
+
+		if len(m.Stripe) > 0 {
+			s.metadata.RegisterShard(m.Owner, m.Key, m.Target)
+		} else {
+			s.metadata.Register(m.Owner, m.Key, m.Target)
+		}
+		s.metadata.Unregister(m.Owner, m.Key, m.Source)
+		report.Moved++
+		report.Bytes += m.Size
+	}
+
+	return report, nil
+}
+
+// balanceLoop runs the balancer every BalanceInterval.
+func (s *FileServer) balanceLoop() {
+	ticker := time.NewTicker(s.BalanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		}
+
+		report, err := s.Balance()
+		if err != nil {
+			log.Printf("[%s] balancing failed: %s", s.Transport.Addr(), err)
+			continue
+		}
+		if report.Planned > 0 {
+			log.Printf("[%s] balancer moved %d of %d replicas (%d bytes)", s.Transport.Addr(), report.Moved, report.Planned, report.Bytes)
+		}
+	}
+}
+
+func (s *FileServer) handleMessageGetUsage(from string, id uint64) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	usage, err := s.usage()
+	if err != nil {
+		usage = MessageUsage{Err: err.Error()}
+	}
+
+	return s.send(peer, &Message{RequestID: id, Payload: usage})
+}
+
+// throttledWriter writes at most rate bytes per second to w, on average since
+// it was created.
+type throttledWriter struct {
+	w       io.Writer
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func newThrottledWriter(w io.Writer, rate int64) *throttledWriter {
+	return &throttledWriter{w: w, rate: rate, start: time.Now()}
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	n, err := t.w.Write(b)
+	t.written += int64(n)
+
+	due := time.Duration(float64(t.written) / float64(t.rate) * float64(time.Second))
+	if ahead := due - time.Since(t.start); ahead > 0 {
+		time.Sleep(ahead)
+	}
+
+	return n, err
+}
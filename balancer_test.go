@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlanMoves(t *testing.T) {
+	replicas := func(owner string, n int) []ReplicaInfo {
+		rs := []ReplicaInfo{}
+		for i := 0; i < n; i++ {
+			rs = append(rs, ReplicaInfo{Owner: owner, Key: fmt.Sprintf("%s_%d", owner, i), Size: 100})
+		}
+		return rs
+	}
+
+	// Every node is a host of its own in a single rack.
+	flat := func(id string) Topology { return Topology{Host: id} }
+
+	full := nodeUsage{ID: "full", MessageUsage: MessageUsage{Used: 1000, Replicas: replicas("owner", 10)}}
+	owner := nodeUsage{ID: "owner", MessageUsage: MessageUsage{Used: 500}}
+	empty := nodeUsage{ID: "empty"}
+
+	moves := planMoves([]nodeUsage{full, owner, empty}, 0.1, flat)
+
+	// The mean is 500, the full node has to get down to 550.
+	if len(moves) != 5 {
+		t.Fatalf("want 5 moves have %d", len(moves))
+	}
+	for _, m := range moves {
+		if m.Source != "full" || m.Target != "empty" {
+			t.Errorf("unexpected move %+v", m)
+		}
+	}
+
+	// Nothing moves to a node that holds the replica already.
+	empty.Replicas = replicas("owner", 10)
+	if moves := planMoves([]nodeUsage{full, owner, empty}, 0.1, flat); len(moves) != 0 {
+		t.Errorf("want no moves have %v", moves)
+	}
+
+	// Nor within the threshold.
+	if moves := planMoves([]nodeUsage{full, {ID: "other", MessageUsage: MessageUsage{Used: 900}}}, 0.1, flat); len(moves) != 0 {
+		t.Errorf("want no moves have %v", moves)
+	}
+}
+
+func TestPlanMovesKeepsReplicasApart(t *testing.T) {
+	topologies := map[string]Topology{
+		"a1":    {Zone: "z1", Rack: "a", Host: "a1"},
+		"a2":    {Zone: "z1", Rack: "a", Host: "a2"},
+		"b1":    {Zone: "z1", Rack: "b", Host: "b1"},
+		"b2":    {Zone: "z1", Rack: "b", Host: "b2"},
+		"owner": {Zone: "z1", Rack: "c", Host: "owner"},
+	}
+	topology := func(id string) Topology { return topologies[id] }
+
+	replicas := []ReplicaInfo{}
+	for i := 0; i < 10; i++ {
+		replicas = append(replicas, ReplicaInfo{Owner: "owner", Key: fmt.Sprintf("owner_%d", i), Size: 100})
+	}
+	// Every key has a replica in rack a and one in rack b.
+	a1 := nodeUsage{ID: "a1", MessageUsage: MessageUsage{Used: 1000, Replicas: replicas}}
+	b1 := nodeUsage{ID: "b1", MessageUsage: MessageUsage{Used: 1000, Replicas: replicas}}
+	owner := nodeUsage{ID: "owner", MessageUsage: MessageUsage{Used: 500}}
+	a2 := nodeUsage{ID: "a2"}
+	b2 := nodeUsage{ID: "b2"}
+
+	// The replicas stay in their rack, whichever empty node comes first.
+	moves := planMoves([]nodeUsage{a1, b1, owner, b2, a2}, 0.1, topology)
+	if len(moves) != 10 {
+		t.Fatalf("want 10 moves have %d", len(moves))
+	}
+	for _, m := range moves {
+		if topologies[m.Source].Rack != topologies[m.Target].Rack {
+			t.Errorf("(%s) moved from %s to %s", m.Key, m.Source, m.Target)
+		}
+	}
+
+	// Rather than putting both replicas of a key in rack b, they stay put.
+	for _, m := range planMoves([]nodeUsage{a1, b1, owner, b2}, 0.1, topology) {
+		if m.Source == "a1" {
+			t.Errorf("(%s) moved from %s to %s", m.Key, m.Source, m.Target)
+		}
+	}
+}
+
+func TestPlanMovesKeepsShardsApart(t *testing.T) {
+	// Without any topology, the failure domains keep nothing apart.
+	unknown := func(id string) Topology { return Topology{} }
+
+	// The full node holds the first shard of every stripe, the other node the
+	// second one.
+	first, second := []ReplicaInfo{}, []ReplicaInfo{}
+	for i := 0; i < 10; i++ {
+		stripe := fmt.Sprintf("stripe_%d", i)
+		first = append(first, ReplicaInfo{Owner: "owner", Key: stripe + "#0", Size: 100, Stripe: stripe})
+		second = append(second, ReplicaInfo{Owner: "owner", Key: stripe + "#1", Size: 1, Stripe: stripe})
+	}
+	full := nodeUsage{ID: "full", MessageUsage: MessageUsage{Used: 1000, Replicas: first}}
+	other := nodeUsage{ID: "other", MessageUsage: MessageUsage{Used: 10, Replicas: second}}
+	owner := nodeUsage{ID: "owner", MessageUsage: MessageUsage{Used: 500}}
+	empty := nodeUsage{ID: "empty"}
+
+	moves := planMoves([]nodeUsage{full, other, owner, empty}, 0.1, unknown)
+	if len(moves) == 0 {
+		t.Fatal("want moves have none")
+	}
+	for _, m := range moves {
+		if m.Target != "empty" {
+			t.Errorf("(%s) moved from %s to %s", m.Key, m.Source, m.Target)
+		}
+	}
+}
+
+func TestThrottledWriter(t *testing.T) {
+	start := time.Now()
+
+	w := newThrottledWriter(io.Discard, 1<<20)
+	if _, err := io.Copy(w, bytes.NewReader(make([]byte, 200<<10))); err != nil {
+		t.Fatal(err)
+	}
+
+	if took := time.Since(start); took < 180*time.Millisecond {
+		t.Errorf("200KiB at 1MiB/s took %s", took)
+	}
+}
+
+func TestFileServerBalance(t *testing.T) {
+	configure := func(s *FileServer) {
+		s.ReplicationFactor = 1
+		s.WriteQuorum = 1
+		// Off the ring, which would move replicas to the new node itself.
+		s.PlacementFunc = func(key string, peers []string, n int) []string {
+			return slices.Sorted(slices.Values(peers))[:min(n, len(peers))]
+		}
+	}
+	servers := startTestCluster(t, configure, ":6190", ":6290")
+	meta, owner := servers[0], servers[1]
+
+	// All replicas end up on the metadata node, the only peer.
+	for i := 0; i < 10; i++ {
+		data := bytes.Repeat([]byte("some jpg bytes"), 100)
+		if err := owner.Store(fmt.Sprintf("picture_%d.png", i), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A node joining later stays empty until the balancer runs.
+	late := makeServer(":6390", ":6190", ":6290")
+	configure(late)
+	go late.Start()
+	t.Cleanup(func() {
+		late.Stop()
+		late.store.Clear()
+	})
+	time.Sleep(300 * time.Millisecond)
+
+	before, err := meta.usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := meta.Balance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Moved == 0 || report.Moved != report.Planned {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	after, err := meta.usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := late.usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Used != before.Used-report.Bytes || moved.Used != report.Bytes {
+		t.Errorf("moved %d bytes, usage went from %d to %d, the new node has %d", report.Bytes, before.Used, after.Used, moved.Used)
+	}
+	for _, r := range moved.Replicas {
+		if holders := meta.metadata.Locate(r.Owner, r.Key); len(holders) != 1 || holders[0] != late.ID {
+			t.Errorf("want (%s) on %s have %v", r.Key, late.ID, holders)
+		}
+	}
+
+	// Every file is still there.
+	if err := owner.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := owner.Get(fmt.Sprintf("picture_%d.png", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
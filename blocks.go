@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+// BlockManifest lists the blocks a file was split into. It is stored and
+// replicated under the key of the file itself.
+type BlockManifest struct {
+	Key       string
+	Size      int64
+	BlockSize int64
+	Blocks    []BlockInfo
+	// Erasure is set when the blocks are stored as erasure coded shards
+	// rather than replicated.
+	Erasure *ErasureCoding
+}
+
+type BlockInfo struct {
+	Key  string
+	Size int64
+}
+
+func blockKey(key string, i int) string {
+	return fmt.Sprintf("%s#block%d", key, i)
+}
+
+// blockFile returns the key of the file the object belongs to, which is the
+// key of the object itself unless it is a block.
+func blockFile(key string) string {
+	file, _, _ := strings.Cut(key, "#block")
+	return file
+}
+
+// manifest returns the block manifest of the file, fetching it from the
+// network if there is no local copy. Files stored before they were split into
+// blocks have no manifest, they are a single block stored under the key of
+// the file.
+func (s *FileServer) manifest(ctx context.Context, key string) (BlockManifest, error) {
+	var manifest BlockManifest
+
+	legacy := s.legacyObject(key)
+	if err := s.getObject(ctx, key); err != nil {
+		return manifest, err
+	}
+
+	size, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return manifest, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	if legacy {
+		return BlockManifest{
+			Key:       key,
+			Size:      size,
+			BlockSize: size,
+			Blocks:    []BlockInfo{{Key: key, Size: size}},
+		}, nil
+	}
+
+	err = gob.NewDecoder(r).Decode(&manifest)
+	return manifest, err
+}
+
+// fetchBlocks fetches every block of the manifest that is not on local disk.
+// The blocks are spread over their owners and every owner serves its share in
+// parallel with the others. Blocks an owner failed to serve are retried on the
+// holders the metadata node knows of afterwards.
+func (s *FileServer) fetchBlocks(ctx context.Context, manifest BlockManifest) error {
+	var (
+		assigned = make(map[p2p.Peer][]string)
+		holders  = make(map[string][]p2p.Peer)
+		legacy   = make(map[string]bool)
+	)
+
+	for _, block := range manifest.Blocks {
+		legacy[block.Key] = s.legacyObject(block.Key)
+		if s.hasValid(block.Key) {
+			continue
+		}
+
+		peers := s.owners(block.Key)
+		if len(peers) == 0 {
+			peers = s.holders(ctx, block.Key, nil)
+		}
+		if len(peers) == 0 {
+			return fmt.Errorf("[%s] no replica holds block (%s)", s.Transport.Addr(), block.Key)
+		}
+
+		least := peers[0]
+		for _, peer := range peers[1:] {
+			if len(assigned[peer]) < len(assigned[least]) {
+				least = peer
+			}
+		}
+
+		assigned[least] = append(assigned[least], block.Key)
+		holders[block.Key] = peers
+	}
+
+	var (
+		wg       sync.WaitGroup
+		failLock sync.Mutex
+		// failed maps the blocks that could not be fetched to the owner that
+		// failed to serve them.
+		failed = make(map[string]p2p.Peer)
+	)
+
+	for peer, keys := range assigned {
+		wg.Add(1)
+		go func(peer p2p.Peer, keys []string) {
+			defer wg.Done()
+
+			for _, key := range keys {
+				n, err := s.fetch(ctx, peer, key, legacy[key])
+				if err != nil {
+					log.Printf("[%s] fetching block (%s) from %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+					failLock.Lock()
+					failed[key] = peer
+					failLock.Unlock()
+					continue
+				}
+
+				fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
+			}
+		}(peer, keys)
+	}
+
+	wg.Wait()
+
+	for key, peer := range failed {
+		retry := slices.DeleteFunc(slices.Clone(holders[key]), func(p p2p.Peer) bool { return p == peer })
+		retry = append(retry, s.holders(ctx, key, holders[key])...)
+		if err := s.getObjectFrom(ctx, key, retry, legacy[key]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// blockReader reads the blocks of a file from local disk one after another.
+type blockReader struct {
+	s      *FileServer
+	blocks []BlockInfo
+	cur    io.Reader
+}
+
+func (s *FileServer) newBlockReader(manifest BlockManifest) *blockReader {
+	return &blockReader{
+		s:      s,
+		blocks: manifest.Blocks,
+	}
+}
+
+func (br *blockReader) Read(b []byte) (int, error) {
+	for {
+		if br.cur == nil {
+			if len(br.blocks) == 0 {
+				return 0, io.EOF
+			}
+
+			_, r, err := br.s.store.Read(br.s.ID, br.blocks[0].Key)
+			if err != nil {
+				return 0, err
+			}
+			br.cur = r
+			br.blocks = br.blocks[1:]
+		}
+
+		n, err := br.cur.Read(b)
+		if err == io.EOF {
+			br.closeCurrent()
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (br *blockReader) closeCurrent() {
+	if rc, ok := br.cur.(io.ReadCloser); ok {
+		rc.Close()
+	}
+	br.cur = nil
+}
+
+func (br *blockReader) Close() error {
+	br.closeCurrent()
+	br.blocks = nil
+	return nil
+}
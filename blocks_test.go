@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestFileServerBlocks(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.ReplicationFactor = 1
+		s.WriteQuorum = 1
+		s.BlockSize = 1024
+	}, ":6106", ":6206", ":6306", ":6406")
+	s := servers[3]
+
+	files := map[string][]byte{
+		// A multiple of the block size does not end with an empty block.
+		"exact.bin": bytes.Repeat([]byte("0123456789abcdef"), 1024),
+		// An empty file still has a single, empty, block.
+		"empty.bin": {},
+		"short.bin": []byte("some jpg bytes"),
+	}
+	blocks := map[string][]int64{
+		"exact.bin": slices.Repeat([]int64{1024}, 16),
+		"empty.bin": {0},
+		"short.bin": {14},
+	}
+
+	for key, data := range files {
+		if err := s.Store(key, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		manifest, err := s.manifest(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Size != int64(len(data)) {
+			t.Errorf("(%s): want size %d have %d", key, len(data), manifest.Size)
+		}
+		if len(manifest.Blocks) != len(blocks[key]) {
+			t.Fatalf("(%s): want %d blocks have %d", key, len(blocks[key]), len(manifest.Blocks))
+		}
+		for i, block := range manifest.Blocks {
+			if block.Key != blockKey(key, i) || block.Size != blocks[key][i] {
+				t.Errorf("(%s): unexpected block %d %+v", key, i, block)
+			}
+		}
+	}
+
+	// With a single replica every block lives on one peer, and the blocks of
+	// the large file are spread over several of them.
+	holders := make(map[string]bool)
+	for i := range blocks["exact.bin"] {
+		for _, peer := range servers[:3] {
+			if peer.store.Has(s.ID, hashKey(blockKey("exact.bin", i))) {
+				holders[peer.ID] = true
+			}
+		}
+	}
+	if len(holders) < 2 {
+		t.Errorf("want the blocks on several peers have %d", len(holders))
+	}
+
+	// Every block has to come back from the network.
+	if err := s.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range files {
+		r, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("(%s): want %d bytes have %d bytes", key, len(data), len(b))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// CorruptionError is returned when the bytes read back for a key do not match
+// the checksum that was recorded when it was written.
+type CorruptionError struct {
+	ID   string
+	Key  string
+	Want string
+	Have string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted object (%s) of %s: checksum is %s, want %s", e.Key, e.ID, e.Have, e.Want)
+}
+
+// verifyingReader hashes everything that is read through it and compares the
+// sum with the expected checksum once the underlying reader hits EOF.
+type verifyingReader struct {
+	r    io.ReadCloser
+	h    hash.Hash
+	id   string
+	key  string
+	want string
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+
+	if err == io.EOF {
+		if have := hex.EncodeToString(v.h.Sum(nil)); have != v.want {
+			return n, &CorruptionError{ID: v.id, Key: v.key, Want: v.want, Have: have}
+		}
+	}
+
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
@@ -1,12 +1,43 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+)
+
+// Every stream produced by copyEncrypt starts with encMagic followed by a
+// format version byte. Streams without the magic predate the header and are
+// raw AES-CTR with the IV prepended.
+//
+// Version 2 is followed by the nonce prefix. Version 3 additionally carries the
+// ID of the key the stream was encrypted with in front of the nonce prefix and
+// authenticates the whole header along with every segment.
+const (
+	encMagic           = "HDFS"
+	encVersionGCM      = 2
+	encVersionKeyID    = 3
+	encKeyIDSize       = 8
+	encNoncePrefixSize = 7
+	encHeaderSize      = len(encMagic) + 1 + encKeyIDSize + encNoncePrefixSize
+	// encSegmentSize is the amount of plaintext sealed in a single segment.
+	encSegmentSize = 64 * 1024
+	encTagSize     = 16
+)
+
+var (
+	errTruncated   = errors.New("encrypted stream is truncated")
+	errTampered    = errors.New("encrypted stream failed authentication")
+	errUnversioned = errors.New("encrypted stream lacks the format header")
 )
 
 func generateID() string {
@@ -26,10 +57,235 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
+// encryptionKeyID identifies a key by a truncated hash of it, which is what
+// gets recorded in the header of everything encrypted with the key.
+func encryptionKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:encKeyIDSize])
+}
+
+// wrapKey seals a data key with a master key. The ID of the data key is
+// authenticated along with it, so a wrapped key cannot pass for another one.
+func wrapKey(master []byte, key []byte) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, key, []byte(encryptionKeyID(key))), nil
+}
+
+// unwrapKey opens a data key sealed by wrapKey and checks that it is the one
+// with the given ID.
+func unwrapKey(master []byte, wrapped []byte, id string) ([]byte, error) {
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is truncated")
+	}
+
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key %s failed", id)
+	}
+
+	return key, nil
+}
+
+// peekKeyID returns the ID of the key the stream was encrypted with, together
+// with a reader that still yields the whole stream. Streams that predate key
+// IDs return an empty ID.
+func peekKeyID(r io.Reader) (string, io.Reader, error) {
+	header := make([]byte, len(encMagic)+1+encKeyIDSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+
+	r = io.MultiReader(bytes.NewReader(header[:n]), r)
+	if n < len(header) || string(header[:len(encMagic)]) != encMagic || header[len(encMagic)] != encVersionKeyID {
+		return "", r, nil
+	}
+
+	return hex.EncodeToString(header[len(encMagic)+1:]), r, nil
+}
+
+// encryptedSize returns the number of bytes copyEncrypt produces for size
+// bytes of plaintext. The stream always ends with a segment shorter than
+// encSegmentSize, which may be empty.
+func encryptedSize(size int64) int64 {
+	segments := size/encSegmentSize + 1
+	return int64(encHeaderSize) + size + segments*encTagSize
+}
+
+// segmentNonce builds the nonce of a segment out of the random prefix of the
+// stream, the sequence number of the segment and whether it is the last one.
+// Reordering, dropping or truncating segments therefore fails authentication.
+func segmentNonce(prefix []byte, seq uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, seq)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// copyEncrypt encrypts src into dst as a sequence of AES-GCM sealed segments
+// and returns the number of bytes written to dst.
+func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	header[len(encMagic)] = encVersionKeyID
+	keyID, _ := hex.DecodeString(encryptionKeyID(key))
+	copy(header[len(encMagic)+1:], keyID)
+	prefix := header[len(encMagic)+1+encKeyIDSize:]
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return 0, err
+	}
+
+	nw, err := dst.Write(header)
+	if err != nil {
+		return nw, err
+	}
+
+	buf := make([]byte, encSegmentSize, encSegmentSize+encTagSize)
+	for seq := uint32(0); ; seq++ {
+		n, err := io.ReadFull(src, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nw, err
+		}
+
+		sealed := aead.Seal(buf[:0], segmentNonce(prefix, seq, last), buf[:n], header)
+		nn, err := dst.Write(sealed)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if last {
+			return nw, nil
+		}
+		if seq == math.MaxUint32 {
+			return nw, errors.New("too many segments to encrypt")
+		}
+	}
+}
+
+// copyDecrypt decrypts src into dst and returns the number of plaintext bytes
+// written to dst. Streams without the format header are refused, since
+// stripping it is all it takes to pass a stream off as unauthenticated.
+func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return decryptStream(key, src, dst, false)
+}
+
+// copyDecryptLegacy is copyDecrypt that decrypts streams without the format
+// header as AES-CTR, which is how they were written before the versioned
+// format was introduced. It is only for objects known to be that old.
+func copyDecryptLegacy(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return decryptStream(key, src, dst, true)
+}
+
+func decryptStream(key []byte, src io.Reader, dst io.Writer, legacy bool) (int, error) {
+	header := make([]byte, encHeaderSize)
+	n, err := io.ReadFull(src, header[:len(encMagic)+1])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	if n < len(encMagic)+1 || string(header[:len(encMagic)]) != encMagic {
+		if !legacy {
+			return 0, errUnversioned
+		}
+		return copyDecryptCTR(key, io.MultiReader(bytes.NewReader(header[:n]), src), dst)
+	}
+
+	var (
+		prefix []byte
+		ad     []byte
+	)
+
+	switch version := header[len(encMagic)]; version {
+	case encVersionGCM:
+		prefix = header[len(encMagic)+1 : len(encMagic)+1+encNoncePrefixSize]
+		if _, err := io.ReadFull(src, prefix); err != nil {
+			return 0, errTruncated
+		}
+	case encVersionKeyID:
+		if _, err := io.ReadFull(src, header[len(encMagic)+1:]); err != nil {
+			return 0, errTruncated
+		}
+		if keyID := hex.EncodeToString(header[len(encMagic)+1 : len(encMagic)+1+encKeyIDSize]); keyID != encryptionKeyID(key) {
+			return 0, fmt.Errorf("stream is encrypted with key %s, not with key %s", keyID, encryptionKeyID(key))
+		}
+		prefix = header[len(encMagic)+1+encKeyIDSize:]
+		ad = header
+	default:
+		return 0, fmt.Errorf("unsupported encryption format version %d", version)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		nw  int
+		buf = make([]byte, encSegmentSize+encTagSize)
+	)
+	for seq := uint32(0); ; seq++ {
+		n, err := io.ReadFull(src, buf)
+		switch err {
+		case nil:
+		case io.ErrUnexpectedEOF:
+		case io.EOF:
+			// A stream always ends with a short segment, so running out of
+			// bytes on a segment boundary means the tail got cut off.
+			return nw, errTruncated
+		default:
+			return nw, err
+		}
+
+		last := n < len(buf)
+		plain, err := aead.Open(buf[:0], segmentNonce(prefix, seq, last), buf[:n], ad)
+		if err != nil {
+			return nw, errTampered
+		}
+
+		nn, err := dst.Write(plain)
+		nw += nn
+		if err != nil || last {
+			return nw, err
+		}
+	}
+}
+
+func copyStream(stream cipher.Stream, src io.Reader, dst io.Writer) (int, error) {
 	var (
 		buf = make([]byte, 32*1024)
-		nw  = blockSize
+		nw  int
 	)
 	for {
 		n, err := src.Read(buf)
@@ -51,7 +307,9 @@ func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Write
 	return nw, nil
 }
 
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+// copyDecryptCTR decrypts the legacy format: the IV followed by the AES-CTR
+// encrypted bytes, without any authentication.
+func copyDecryptCTR(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return 0, err
@@ -60,30 +318,10 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	// Read the IV from the given io.Reader which, in our case should be the
 	// the block.BlockSize() bytes we read.
 	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
-		return 0, err
-	}
-
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
-}
-
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return 0, err
-	}
-
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return 0, err
-	}
-
-	// prepend the IV to the file.
-	if _, err := dst.Write(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 
 	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
+	return copyStream(stream, src, dst)
 }
@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"testing"
 )
 
@@ -19,13 +23,17 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	fmt.Println(len(payload))
 	fmt.Println(len(dst.String()))
 
+	if int64(dst.Len()) != encryptedSize(int64(len(payload))) {
+		t.Errorf("want %d encrypted bytes have %d", encryptedSize(int64(len(payload))), dst.Len())
+	}
+
 	out := new(bytes.Buffer)
 	nw, err := copyDecrypt(key, dst, out)
 	if err != nil {
 		t.Error(err)
 	}
 
-	if nw != 16+len(payload) {
+	if nw != len(payload) {
 		t.Fail()
 	}
 
@@ -33,3 +41,98 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Errorf("decryption failed!!!")
 	}
 }
+
+func TestCopyEncryptDecryptSegments(t *testing.T) {
+	key := newEncryptionKey()
+
+	for _, size := range []int{0, 1, encSegmentSize - 1, encSegmentSize, 3*encSegmentSize + 7} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+
+		dst := new(bytes.Buffer)
+		if _, err := copyEncrypt(key, bytes.NewReader(payload), dst); err != nil {
+			t.Fatal(err)
+		}
+		if int64(dst.Len()) != encryptedSize(int64(size)) {
+			t.Errorf("size %d: want %d encrypted bytes have %d", size, encryptedSize(int64(size)), dst.Len())
+		}
+
+		out := new(bytes.Buffer)
+		if _, err := copyDecrypt(key, dst, out); err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), payload) {
+			t.Errorf("size %d: decryption failed", size)
+		}
+	}
+}
+
+func TestCopyDecryptDetectsTamperingAndTruncation(t *testing.T) {
+	key := newEncryptionKey()
+	payload := make([]byte, 2*encSegmentSize+100)
+	rand.Read(payload)
+
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(payload), encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := bytes.Clone(encrypted.Bytes())
+	tampered[encHeaderSize+10] ^= 0x01
+	if _, err := copyDecrypt(key, bytes.NewReader(tampered), io.Discard); err != errTampered {
+		t.Errorf("want %v have %v", errTampered, err)
+	}
+
+	// Cutting off the last segment leaves a stream that ends on a segment
+	// boundary, cutting in the middle of a segment breaks its tag.
+	boundary := encHeaderSize + 2*(encSegmentSize+encTagSize)
+	if _, err := copyDecrypt(key, bytes.NewReader(encrypted.Bytes()[:boundary]), io.Discard); err != errTruncated {
+		t.Errorf("want %v have %v", errTruncated, err)
+	}
+	if _, err := copyDecrypt(key, bytes.NewReader(encrypted.Bytes()[:boundary-5]), io.Discard); err != errTampered {
+		t.Errorf("want %v have %v", errTampered, err)
+	}
+
+	// Breaking the magic must not downgrade the stream to unauthenticated
+	// AES-CTR.
+	downgraded := bytes.Clone(encrypted.Bytes())
+	downgraded[0] ^= 0x01
+	if _, err := copyDecrypt(key, bytes.NewReader(downgraded), io.Discard); err != errUnversioned {
+		t.Errorf("want %v have %v", errUnversioned, err)
+	}
+}
+
+// encryptLegacy encrypts data the way replicas were encrypted before the
+// versioned format: the IV followed by the AES-CTR encrypted bytes.
+func encryptLegacy(tb testing.TB, key []byte, data []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	iv := make([]byte, block.BlockSize())
+	rand.Read(iv)
+
+	ciphertext := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, data)
+
+	return append(iv, ciphertext...)
+}
+
+func TestCopyDecryptLegacyCTR(t *testing.T) {
+	key := newEncryptionKey()
+	payload := "Foo not bar"
+
+	encrypted := bytes.NewBuffer(encryptLegacy(t, key, []byte(payload)))
+
+	if _, err := copyDecrypt(key, bytes.NewReader(encrypted.Bytes()), io.Discard); err != errUnversioned {
+		t.Errorf("want %v have %v", errUnversioned, err)
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecryptLegacy(key, encrypted, out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != payload {
+		t.Errorf("want %s have %s", payload, out.String())
+	}
+}
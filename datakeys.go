@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// wrappedKey is a data key sealed with one of the master keys of the node.
+type wrappedKey struct {
+	// File is the key of the file the data key encrypts.
+	File     string
+	MasterID string
+	Wrapped  []byte
+}
+
+// dataKeyChange is a change to the data keys as it is logged: the data key
+// with the ID is set to Key, or removed.
+type dataKeyChange struct {
+	ID      string
+	Key     wrappedKey
+	Removed bool
+}
+
+// DataKeys holds the data keys of the files a node owns. Every file is
+// encrypted with a data key of its own that is only ever persisted wrapped
+// with a master key. Revoking a file comes down to forgetting its data key,
+// and rotating the master key to wrapping the data keys again, without
+// touching a single replica.
+//
+// The data keys are persisted as a snapshot of all of them, at path, and a
+// log of the changes made since, at path.log, so a change does not rewrite
+// every key. The log is folded into the snapshot once it holds more changes
+// than there are keys.
+type DataKeys struct {
+	path string
+
+	lock sync.RWMutex
+	// keys maps the ID of a data key to the wrapped key.
+	keys map[string]wrappedKey
+	// logged is the number of changes in the log.
+	logged int
+}
+
+// OpenDataKeys loads the data keys persisted at path. An empty path keeps the
+// data keys in memory only.
+func OpenDataKeys(path string) (*DataKeys, error) {
+	dk := &DataKeys{
+		path: path,
+		keys: make(map[string]wrappedKey),
+	}
+	if len(path) == 0 {
+		return dk, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&dk.keys); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := dk.replay(); err != nil {
+		return nil, err
+	}
+
+	return dk, nil
+}
+
+func (dk *DataKeys) logPath() string {
+	return dk.path + ".log"
+}
+
+// replay applies the logged changes. A change that was cut short by a crash
+// ends the log, and is cut off so the next change is not appended after it.
+func (dk *DataKeys) replay() error {
+	b, err := os.ReadFile(dk.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(b)
+	for {
+		offset := len(b) - r.Len()
+
+		var size uint32
+		err := binary.Read(r, binary.BigEndian, &size)
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) || int64(size) > int64(r.Len()) {
+			return os.Truncate(dk.logPath(), int64(offset))
+		}
+		if err != nil {
+			return err
+		}
+		record := make([]byte, size)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return err
+		}
+
+		var change dataKeyChange
+		if err := gob.NewDecoder(bytes.NewReader(record)).Decode(&change); err != nil {
+			return err
+		}
+		change.apply(dk.keys)
+		dk.logged++
+	}
+}
+
+func (c dataKeyChange) apply(keys map[string]wrappedKey) {
+	if c.Removed {
+		delete(keys, c.ID)
+	} else {
+		keys[c.ID] = c.Key
+	}
+}
+
+// Add wraps the data key of the file with the given master key and persists
+// it. It returns the ID of the data key.
+func (dk *DataKeys) Add(file string, masterID string, master []byte, key []byte) (string, error) {
+	wrapped, err := wrapKey(master, key)
+	if err != nil {
+		return "", err
+	}
+
+	id := encryptionKeyID(key)
+
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+
+	change := dataKeyChange{
+		ID: id,
+		Key: wrappedKey{
+			File:     file,
+			MasterID: masterID,
+			Wrapped:  wrapped,
+		},
+	}
+	if err := dk.change(change); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Replace forgets every data key of the file but the one with the given ID,
+// once the file was written again with that one. It returns the number of
+// data keys removed.
+func (dk *DataKeys) Replace(file string, id string) (int, error) {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+
+	return dk.remove(func(other string, wk wrappedKey) bool {
+		return wk.File == file && other != id
+	})
+}
+
+// Has reports whether id is the ID of a data key.
+func (dk *DataKeys) Has(id string) bool {
+	dk.lock.RLock()
+	defer dk.lock.RUnlock()
+
+	_, ok := dk.keys[id]
+	return ok
+}
+
+// HasFile reports whether there is a data key for the file.
+func (dk *DataKeys) HasFile(file string) bool {
+	dk.lock.RLock()
+	defer dk.lock.RUnlock()
+
+	for _, wk := range dk.keys {
+		if wk.File == file {
+			return true
+		}
+	}
+	return false
+}
+
+// Key unwraps the data key with the given ID. master looks up the master key
+// the data key was wrapped with.
+func (dk *DataKeys) Key(id string, master func(id string) ([]byte, error)) ([]byte, error) {
+	dk.lock.RLock()
+	wk, ok := dk.keys[id]
+	dk.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("data key %s not found, the file may have been revoked", id)
+	}
+
+	mk, err := master(wk.MasterID)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrapKey(mk, wk.Wrapped, id)
+}
+
+// Revoke forgets every data key of the file, which leaves its replicas
+// impossible to decrypt. It returns the number of data keys removed.
+func (dk *DataKeys) Revoke(file string) (int, error) {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+
+	return dk.remove(func(id string, wk wrappedKey) bool {
+		return wk.File == file
+	})
+}
+
+// remove forgets the data keys that match, and returns how many there were.
+func (dk *DataKeys) remove(match func(id string, wk wrappedKey) bool) (int, error) {
+	changes := []dataKeyChange{}
+	for id, wk := range dk.keys {
+		if match(id, wk) {
+			changes = append(changes, dataKeyChange{ID: id, Removed: true})
+		}
+	}
+
+	if err := dk.change(changes...); err != nil {
+		return 0, err
+	}
+
+	return len(changes), nil
+}
+
+// Rewrap wraps every data key that is not wrapped with the given master key
+// yet with it. master looks up the master keys the data keys are currently
+// wrapped with. It returns the number of data keys rewrapped.
+func (dk *DataKeys) Rewrap(masterID string, key []byte, master func(id string) ([]byte, error)) (int, error) {
+	dk.lock.Lock()
+	defer dk.lock.Unlock()
+
+	changes := []dataKeyChange{}
+	for id, wk := range dk.keys {
+		if wk.MasterID == masterID {
+			continue
+		}
+
+		mk, err := master(wk.MasterID)
+		if err != nil {
+			return 0, err
+		}
+		dataKey, err := unwrapKey(mk, wk.Wrapped, id)
+		if err != nil {
+			return 0, err
+		}
+		if wk.Wrapped, err = wrapKey(key, dataKey); err != nil {
+			return 0, err
+		}
+		wk.MasterID = masterID
+
+		changes = append(changes, dataKeyChange{ID: id, Key: wk})
+	}
+
+	if err := dk.change(changes...); err != nil {
+		return 0, err
+	}
+
+	return len(changes), nil
+}
+
+// change logs the changes and then applies them. The log is folded into the
+// snapshot when it grew past the number of keys.
+func (dk *DataKeys) change(changes ...dataKeyChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if len(dk.path) == 0 {
+		for _, c := range changes {
+			c.apply(dk.keys)
+		}
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	for _, c := range changes {
+		record := new(bytes.Buffer)
+		if err := gob.NewEncoder(record).Encode(c); err != nil {
+			return err
+		}
+		if err := binary.Write(buf, binary.BigEndian, uint32(record.Len())); err != nil {
+			return err
+		}
+		buf.Write(record.Bytes())
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dk.path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dk.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		c.apply(dk.keys)
+	}
+	dk.logged += len(changes)
+
+	// The changes are persisted already, a snapshot that fails is taken
+	// again with the next change.
+	if dk.logged > len(dk.keys) {
+		if err := dk.compact(); err != nil {
+			log.Printf("compacting the data keys in %s failed: %s", dk.path, err)
+		}
+	}
+
+	return nil
+}
+
+// compact writes a snapshot of the keys and empties the log. Replaying the
+// log over the new snapshot, after a crash in between, changes nothing.
+func (dk *DataKeys) compact() error {
+	if err := dk.save(dk.keys); err != nil {
+		return err
+	}
+	if err := os.Remove(dk.logPath()); err != nil {
+		return err
+	}
+	dk.logged = 0
+
+	return nil
+}
+
+func (dk *DataKeys) save(keys map[string]wrappedKey) error {
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(keys); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dk.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := dk.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dk.path)
+}
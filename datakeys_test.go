@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+func TestDataKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "datakeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path    = dir + "/datakeys"
+		oldKey  = newEncryptionKey()
+		newKey  = newEncryptionKey()
+		masters = map[string][]byte{
+			encryptionKeyID(oldKey): oldKey,
+			encryptionKeyID(newKey): newKey,
+		}
+		master = func(id string) ([]byte, error) { return masters[id], nil }
+	)
+
+	dk, err := OpenDataKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey := newEncryptionKey()
+	id, err := dk.Add("picture.png", encryptionKeyID(oldKey), oldKey, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dk.Add("other.png", encryptionKeyID(oldKey), oldKey, newEncryptionKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := dk.Rewrap(encryptionKeyID(newKey), newKey, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 rewrapped keys have %d", n)
+	}
+
+	// Reopening must bring back the data keys, wrapped with the new key only.
+	delete(masters, encryptionKeyID(oldKey))
+	dk, err = OpenDataKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := dk.Key(id, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, dataKey) {
+		t.Errorf("data key changed after rewrapping")
+	}
+
+	if n, err := dk.Revoke("picture.png"); err != nil || n != 1 {
+		t.Fatalf("want 1 revoked key have %d (%v)", n, err)
+	}
+	if _, err := dk.Key(id, master); err == nil {
+		t.Errorf("expected a revoked data key to be gone")
+	}
+	if len(dk.keys) != 1 {
+		t.Errorf("want 1 data key left have %d", len(dk.keys))
+	}
+}
+
+func TestDataKeysLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "datakeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		path   = dir + "/datakeys"
+		master = newEncryptionKey()
+	)
+
+	dk, err := OpenDataKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := dk.Add("picture.png", encryptionKeyID(master), master, newEncryptionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dk.Add("other.png", encryptionKeyID(master), master, newEncryptionKey()); err != nil {
+		t.Fatal(err)
+	}
+
+	// New keys are only appended to the log.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected no snapshot yet (%v)", err)
+	}
+
+	// A change cut short by a crash is dropped, the ones before it stay.
+	logged, err := os.Stat(path + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dk, err = OpenDataKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dk.Has(old) || len(dk.keys) != 2 {
+		t.Errorf("unexpected data keys %v", dk.keys)
+	}
+	if fi, err := os.Stat(path + ".log"); err != nil || fi.Size() != logged.Size() {
+		t.Errorf("expected the log to be cut back to %d bytes (%v)", logged.Size(), err)
+	}
+
+	// Overwriting a file leaves it with the new key only.
+	id, err := dk.Add("picture.png", encryptionKeyID(master), master, newEncryptionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := dk.Replace("picture.png", id); err != nil || n != 1 {
+		t.Fatalf("want 1 replaced key have %d (%v)", n, err)
+	}
+
+	dk, err = OpenDataKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dk.Has(old) || !dk.Has(id) || len(dk.keys) != 2 {
+		t.Errorf("unexpected data keys %v", dk.keys)
+	}
+
+	if n, err := dk.Revoke("other.png"); err != nil || n != 1 {
+		t.Fatalf("want 1 revoked key have %d (%v)", n, err)
+	}
+	dk, err = OpenDataKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dk.Has(id) || len(dk.keys) != 1 {
+		t.Errorf("unexpected data keys %v", dk.keys)
+	}
+}
+
+func TestFileServerDropsDataKeys(t *testing.T) {
+	servers := startTestServers(t, ":6124", ":6224", ":6324")
+	s := servers[2]
+
+	for i := 0; i < 2; i++ {
+		if err := s.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.DataKeys.keys) != 1 {
+		t.Errorf("want 1 data key after overwriting have %d", len(s.DataKeys.keys))
+	}
+
+	if err := s.Delete("picture.png"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.DataKeys.keys) != 0 {
+		t.Errorf("want no data key after deleting have %d", len(s.DataKeys.keys))
+	}
+}
+
+func TestFileServerPersistsDataKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "datakeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := FileServerOpts{
+		EncKey:      newEncryptionKey(),
+		StorageRoot: dir,
+		Transport:   p2p.NewTCPTransport(p2p.TCPTransportOpts{ListenAddr: ":6107"}),
+	}
+	s := NewFileServer(opts)
+	dataKey, err := s.newDataKey("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted server without explicit data keys still has the key.
+	s = NewFileServer(opts)
+	key, err := s.decryptionKey(encryptionKeyID(dataKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, dataKey) {
+		t.Errorf("data key changed across restarts")
+	}
+}
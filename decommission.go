@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+// DecommissionState is how far the retirement of a node got.
+type DecommissionState int
+
+const (
+	// NotDecommissioned nodes take part in the cluster as usual.
+	NotDecommissioned DecommissionState = iota
+	// Decommissioning nodes get no new data and are moving theirs away.
+	Decommissioning
+	// Decommissioned nodes can be shut down without losing any replica.
+	Decommissioned
+)
+
+func (st DecommissionState) String() string {
+	switch st {
+	case NotDecommissioned:
+		return "in service"
+	case Decommissioning:
+		return "decommissioning"
+	case Decommissioned:
+		return "safe to shut down"
+	}
+	return "unknown"
+}
+
+// DecommissionStatus reports the progress of Decommission.
+type DecommissionStatus struct {
+	State DecommissionState
+	// Remaining is the number of objects that would lose redundancy if the
+	// node was shut down, as of the last run of Decommission.
+	Remaining int
+}
+
+// DecommissionStatus returns the progress of Decommission.
+func (s *FileServer) DecommissionStatus() DecommissionStatus {
+	s.decommissionLock.Lock()
+	defer s.decommissionLock.Unlock()
+
+	return s.decommissionStatus
+}
+
+func (s *FileServer) setDecommissionStatus(status DecommissionStatus) {
+	s.decommissionLock.Lock()
+	defer s.decommissionLock.Unlock()
+
+	s.decommissionStatus = status
+}
+
+// Decommission retires the node. The node is marked as decommissioning, which
+// is gossiped to the cluster so no new data is placed on it, and then makes
+// sure every key it holds meets the replication factor without it: replicas
+// held for other nodes are copied to new targets, and our own files are
+// replicated again if some of their replicas are gone. Once Decommission
+// returns nil the node can be shut down. It can be called again if it failed.
+//
+// The data keys of our own files stay with the node, keep its keystore and
+// data key table around to read them later.
+func (s *FileServer) Decommission() error {
+	if s.MetadataNode {
+		return errors.New("the metadata node cannot be decommissioned")
+	}
+
+	s.members.decommission()
+	s.setDecommissionStatus(DecommissionStatus{State: Decommissioning})
+
+	// Tell every peer right away rather than waiting for the gossip.
+	s.peerLock.Lock()
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	s.peerLock.Unlock()
+
+	msg := &Message{Payload: MessageGossip{Members: s.Members()}}
+	for _, peer := range peers {
+		if err := s.send(peer, msg); err != nil {
+			log.Printf("[%s] announcing decommission to %s failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+		}
+	}
+
+	remaining, err := s.migrate()
+	if err != nil {
+		return err
+	}
+
+	if remaining > 0 {
+		s.setDecommissionStatus(DecommissionStatus{State: Decommissioning, Remaining: remaining})
+		return fmt.Errorf("[%s] %d objects still depend on this node", s.Transport.Addr(), remaining)
+	}
+
+	s.setDecommissionStatus(DecommissionStatus{State: Decommissioned})
+	log.Printf("[%s] decommissioned, safe to shut down", s.Transport.Addr())
+
+	return nil
+}
+
+// migrate makes sure every object in the store meets the replication factor
+// without us, and returns the number of objects that do not.
+func (s *FileServer) migrate() (int, error) {
+	ids, err := s.store.IDs()
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := 0
+	for _, id := range ids {
+		metas, err := s.store.Metas(id)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, meta := range metas {
+			if id == s.ID {
+				err = s.migrateOwned(meta)
+			} else if meta.Shard {
+				err = s.migrateShard(id, meta)
+			} else {
+				err = s.migrateReplica(id, meta.Key)
+			}
+			if err != nil {
+				log.Printf("[%s] migrating (%s) failed: %s", s.Transport.Addr(), meta.Key, err)
+				remaining++
+			}
+		}
+	}
+
+	return remaining, nil
+}
+
+// migrateReplica copies our replica of the owner's key to as many new targets
+// as it takes to meet the replication factor without us.
+func (s *FileServer) migrateReplica(owner string, key string) error {
+	holders, err := s.locate(context.Background(), owner, key)
+	if err != nil {
+		return err
+	}
+
+	others := 0
+	for _, id := range holders {
+		if id != s.ID {
+			others++
+		}
+	}
+	need := s.ReplicationFactor - others
+	if need <= 0 {
+		return nil
+	}
+
+	exclude := append([]string{owner, s.ID}, holders...)
+	targets := s.placeReplicas(key, exclude, need)
+	if len(targets) < need {
+		return fmt.Errorf("want %d more replicas, only %d nodes are left", need, len(targets))
+	}
+
+	for _, target := range targets {
+		if err := s.transferReplica(MessageReplicate{Owner: owner, Key: key, Target: target}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateShard copies our shard of the owner's stripe to a new node, unless
+// another node holds it already. Shards are never replicated, so exactly one
+// copy is made, and it is kept away from the nodes holding the other shards
+// of the stripe.
+func (s *FileServer) migrateShard(owner string, meta ObjectMeta) error {
+	if meta.Stripe == nil {
+		return fmt.Errorf("shard (%s) does not know its stripe", meta.Key)
+	}
+
+	holders, err := s.locate(context.Background(), owner, meta.Key)
+	if err != nil {
+		return err
+	}
+	for _, id := range holders {
+		if id != s.ID {
+			return nil
+		}
+	}
+
+	exclude := []string{owner, s.ID}
+	for _, key := range meta.Stripe.Shards {
+		if key == meta.Key {
+			continue
+		}
+		others, err := s.locate(context.Background(), owner, key)
+		if err != nil {
+			return err
+		}
+		exclude = append(exclude, others...)
+	}
+
+	targets := s.placeReplicas(meta.Key, exclude, 1)
+	if len(targets) == 0 {
+		return fmt.Errorf("no node left to place shard (%s) on", meta.Key)
+	}
+
+	shard, err := s.readShard(owner, meta.Key, []string{s.ID})
+	if err != nil {
+		return err
+	}
+
+	return s.storeShard(targets[0], *meta.Stripe, meta.Key, shard)
+}
+
+// migrateOwned replicates one of our own objects again if some of its
+// replicas are gone. Decommissioning nodes are never chosen as targets.
+func (s *FileServer) migrateOwned(meta ObjectMeta) error {
+	holders, err := s.locate(context.Background(), s.ID, hashKey(meta.Key))
+	if err != nil {
+		return err
+	}
+	if len(holders) >= s.ReplicationFactor {
+		return nil
+	}
+
+	encKey, err := s.decryptionKey(meta.KeyID)
+	if err != nil {
+		return err
+	}
+
+	return s.replicateObject(meta.Key, meta.Size, encKey)
+}
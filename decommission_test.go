@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFileServerDecommission(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.ReplicationFactor = 2
+		s.WriteQuorum = 2
+	}, ":6105", ":6205", ":6305", ":6405")
+	meta, retiring, owner := servers[0], servers[1], servers[3]
+
+	if err := meta.Decommission(); err == nil {
+		t.Errorf("expected the metadata node to refuse")
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := owner.Store(fmt.Sprintf("picture_%d.png", i), bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := retiring.usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before.Replicas) == 0 {
+		t.Fatal("the retiring node holds no replica to migrate")
+	}
+
+	if st := retiring.DecommissionStatus(); st.State != NotDecommissioned {
+		t.Fatalf("want %s have %s", NotDecommissioned, st.State)
+	}
+	if err := retiring.Decommission(); err != nil {
+		t.Fatal(err)
+	}
+	if st := retiring.DecommissionStatus(); st.State != Decommissioned || st.Remaining != 0 {
+		t.Fatalf("want %s have %+v", Decommissioned, st)
+	}
+
+	// Every key the node held meets the replication factor without it.
+	time.Sleep(100 * time.Millisecond)
+	for _, r := range before.Replicas {
+		others := 0
+		for _, id := range meta.metadata.Locate(r.Owner, r.Key) {
+			if id != retiring.ID {
+				others++
+			}
+		}
+		if others < 2 {
+			t.Errorf("(%s) has %d replicas without the retiring node", r.Key, others)
+		}
+	}
+
+	// New data goes elsewhere.
+	if err := owner.Store("new.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	if retiring.store.Has(owner.ID, hashKey(blockKey("new.png", 0))) {
+		t.Errorf("new data was placed on the retiring node")
+	}
+
+	// Shutting the node down loses nothing.
+	retiring.Stop()
+	retiring.store.Clear()
+	if err := owner.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := owner.Get(fmt.Sprintf("picture_%d.png", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileServerDecommissionMovesShards(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.HeartbeatInterval = 50 * time.Millisecond
+		s.detector = newFailureDetector(150*time.Millisecond, 300*time.Millisecond)
+	}, ":6117", ":6217", ":6317", ":6417", ":6517", ":6617")
+	meta, owner := servers[0], servers[5]
+
+	ec := ErasureCoding{Data: 2, Parity: 1}
+	if err := owner.StoreErasureCoded("cold.log", bytes.NewReader([]byte("some log lines")), ec); err != nil {
+		t.Fatal(err)
+	}
+	block := blockKey("cold.log", 0)
+	shards := []string{}
+	for i := 0; i < ec.Shards(); i++ {
+		shards = append(shards, hashKey(shardKey(block, i)))
+	}
+
+	// Retire a node holding one of the shards.
+	var (
+		retiring *FileServer
+		shard    string
+	)
+	for _, s := range servers[1:5] {
+		for _, key := range shards {
+			if s.store.Has(owner.ID, key) {
+				retiring, shard = s, key
+			}
+		}
+	}
+	if retiring == nil {
+		t.Fatal("no node but the metadata node holds a shard")
+	}
+	if err := retiring.Decommission(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Exactly one other node got the shard, and none of the others.
+	time.Sleep(100 * time.Millisecond)
+	holders := []string{}
+	for _, id := range meta.metadata.Locate(owner.ID, shard) {
+		if id != retiring.ID {
+			holders = append(holders, id)
+		}
+	}
+	if len(holders) != 1 {
+		t.Fatalf("want the shard on 1 other node have %v", holders)
+	}
+	for _, key := range shards {
+		if key == shard {
+			continue
+		}
+		for _, id := range meta.metadata.Locate(owner.ID, key) {
+			if id == holders[0] {
+				t.Errorf("%s holds two shards of the stripe", id)
+			}
+		}
+	}
+	if !meta.metadata.isShard(owner.ID, shard) {
+		t.Errorf("the moved shard is not tracked as a shard")
+	}
+
+	// Shutting the node down loses nothing.
+	retiring.Stop()
+	retiring.store.Clear()
+	eventually(t, "the retired node was not dropped", func() bool {
+		_, ok := owner.peer(retiring.ID)
+		return !ok
+	})
+	if err := owner.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owner.Get("cold.log"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+// ErasureCoding is a Reed-Solomon Data+Parity scheme. Every block is cut into
+// Data shards and Parity more shards are computed from them, each stored on a
+// node of its own. Any Data of the shards rebuild the block, so it survives
+// the loss of Parity nodes at (Data+Parity)/Data times its size, rather than
+// at ReplicationFactor times.
+//
+// The shards are cut from the encrypted block, so any node can rebuild a lost
+// shard without being able to read the file.
+type ErasureCoding struct {
+	Data   int
+	Parity int
+}
+
+func (ec ErasureCoding) String() string {
+	return fmt.Sprintf("RS(%d,%d)", ec.Data, ec.Parity)
+}
+
+// Shards returns the number of shards every block is stored as.
+func (ec ErasureCoding) Shards() int {
+	return ec.Data + ec.Parity
+}
+
+func (ec ErasureCoding) validate() error {
+	_, err := newReedSolomon(ec.Data, ec.Parity)
+	return err
+}
+
+// MessageRegisterStripe tells the metadata node which shards a block was
+// stored as, and on which nodes in the same order, so it can rebuild the ones
+// that get lost.
+type MessageRegisterStripe struct {
+	Stripe
+	Holders []string
+}
+
+func shardKey(block string, i int) string {
+	return fmt.Sprintf("%s#shard%d", block, i)
+}
+
+// storeStripe encrypts the block, cuts it into shards and sends every shard to
+// a peer of its own, chosen by the placement policy. Unlike replicated blocks
+// no local copy is kept. It returns the size of the block.
+func (s *FileServer) storeStripe(key string, r io.Reader, encKey []byte, ec ErasureCoding) (int64, error) {
+	rs, err := newReedSolomon(ec.Data, ec.Parity)
+	if err != nil {
+		return 0, err
+	}
+
+	// Blocks are at most BlockSize bytes, which have to be in memory to be
+	// encoded.
+	cr := &countingReader{r: r}
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(encKey, cr, encrypted); err != nil {
+		return 0, err
+	}
+
+	shards := rs.split(encrypted.Bytes())
+	rs.encode(shards)
+
+	targets := s.replicaTargets(hashKey(key), ec.Shards())
+	if len(targets) < ec.Shards() {
+		return 0, fmt.Errorf("[%s] not enough peers to store (%s) as %s: have %d, need %d", s.Transport.Addr(), key, ec, len(targets), ec.Shards())
+	}
+
+	id, replies := s.pending.add(len(targets))
+	defer s.pending.remove(id)
+
+	var (
+		stripe    = Stripe{Owner: s.ID, Key: hashKey(key), Data: ec.Data}
+		holders   = []string{}
+		checksums = make(map[string]string)
+	)
+	for i := range shards {
+		stripe.Shards = append(stripe.Shards, hashKey(shardKey(key, i)))
+	}
+
+	for i, shard := range shards {
+		holders = append(holders, targets[i].Identity().ID)
+
+		msg := &Message{
+			RequestID: id,
+			Payload: MessageStoreFile{
+				ID:     s.ID,
+				Key:    stripe.Shards[i],
+				Size:   int64(len(shard)),
+				Shard:  true,
+				Stripe: &stripe,
+			},
+		}
+		checksum, err := s.streamObject(targets[i], msg, writeBytes(shard))
+		if err != nil {
+			log.Printf("[%s] sending shard %d of (%s) to %s failed: %s", s.Transport.Addr(), i, key, targets[i].RemoteAddr(), err)
+			continue
+		}
+		checksums[targets[i].Identity().ID] = checksum
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	if acked := s.waitAcks(ctx, replies, checksums); acked < len(shards) {
+		return 0, fmt.Errorf("[%s] stored %d of the %d shards of (%s)", s.Transport.Addr(), acked, len(shards), key)
+	}
+
+	return cr.n, s.registerStripe(stripe, holders)
+}
+
+func writeBytes(b []byte) func(io.Writer) (int64, error) {
+	return func(w io.Writer) (int64, error) {
+		n, err := w.Write(b)
+		return int64(n), err
+	}
+}
+
+// registerStripe reports the shards of one of our blocks, and their holders,
+// to the metadata node. The holders report their shards themselves as well,
+// but the stripe must not look degraded until their reports come in.
+func (s *FileServer) registerStripe(st Stripe, holders []string) error {
+	if s.MetadataNode {
+		s.metadata.RegisterStripe(st, holders)
+		return nil
+	}
+
+	peer, ok := s.metadataPeerConn()
+	if !ok {
+		return nil
+	}
+
+	return s.send(peer, &Message{Payload: MessageRegisterStripe{Stripe: st, Holders: holders}})
+}
+
+// registerShard reports a shard of the stripe we hold to the metadata node.
+func (s *FileServer) registerShard(owner string, key string, stripe *Stripe) error {
+	held := MessageRegisterReplica{
+		Owner:  owner,
+		Key:    key,
+		Holder: s.ID,
+		Shard:  true,
+		Stripe: stripe,
+	}
+
+	if s.MetadataNode {
+		s.registerHeld(held)
+		return nil
+	}
+
+	peer, ok := s.metadataPeerConn()
+	if !ok {
+		return nil
+	}
+
+	return s.send(peer, &Message{Payload: held})
+}
+
+// fetchStripes rebuilds every block of the erasure coded file that is not on
+// local disk out of its shards.
+func (s *FileServer) fetchStripes(ctx context.Context, manifest BlockManifest) error {
+	for _, block := range manifest.Blocks {
+		if s.hasValid(block.Key) {
+			continue
+		}
+
+		if err := s.fetchStripe(ctx, block, *manifest.Erasure); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fetchStripe fetches the shards of the block until it has Data of them,
+// asking for the data shards first as they need no decoding, and writes the
+// decrypted block to disk. Every shard is asked from the peer the placement
+// policy put it on, then from the holder the metadata node knows of.
+func (s *FileServer) fetchStripe(ctx context.Context, block BlockInfo, ec ErasureCoding) error {
+	rs, err := newReedSolomon(ec.Data, ec.Parity)
+	if err != nil {
+		return err
+	}
+
+	targets := s.replicaTargets(hashKey(block.Key), ec.Shards())
+	shards := make([][]byte, ec.Shards())
+
+	have := 0
+	for i := range shards {
+		if have == ec.Data {
+			break
+		}
+
+		key := shardKey(block.Key, i)
+		tried := []p2p.Peer{}
+		if i < len(targets) {
+			tried = append(tried, targets[i])
+		}
+
+		shard, err := s.fetchShardFrom(ctx, key, tried)
+		if err != nil {
+			shard, err = s.fetchShardFrom(ctx, key, s.holders(ctx, key, tried))
+		}
+		if err != nil {
+			continue
+		}
+		shards[i] = shard
+		have++
+	}
+
+	if err := rs.reconstruct(shards); err != nil {
+		return fmt.Errorf("[%s] rebuilding block (%s) out of %d shards: %w", s.Transport.Addr(), block.Key, have, err)
+	}
+	encrypted := rs.join(shards, int(encryptedSize(block.Size)))
+
+	keyID, body, err := peekKeyID(bytes.NewReader(encrypted))
+	if err != nil {
+		return err
+	}
+	encKey, err := s.decryptionKey(keyID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.store.WriteDecrypt(encKey, s.ID, block.Key, body); err != nil {
+		s.store.Delete(s.ID, block.Key)
+		return err
+	}
+
+	fmt.Printf("[%s] rebuilt block (%s) out of %d shards\n", s.Transport.Addr(), block.Key, have)
+
+	return s.store.SetKeyID(s.ID, block.Key, keyID)
+}
+
+// fetchShardFrom tries the given peers in order until one of them serves our
+// shard of the key.
+func (s *FileServer) fetchShardFrom(ctx context.Context, key string, peers []p2p.Peer) ([]byte, error) {
+	for _, peer := range peers {
+		shard, err := s.fetchShard(ctx, peer, s.ID, hashKey(key))
+		if err != nil {
+			log.Printf("[%s] fetching shard (%s) from %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		return shard, nil
+	}
+
+	return nil, fmt.Errorf("[%s] could not fetch shard (%s) from any peer", s.Transport.Addr(), key)
+}
+
+// fetchShard reads the peer's shard of the owner's (hashed) key into memory.
+func (s *FileServer) fetchShard(ctx context.Context, peer p2p.Peer, owner string, key string) ([]byte, error) {
+	var shard []byte
+
+	err := s.fetchReplica(ctx, peer, owner, key, func(r io.Reader) error {
+		var err error
+		shard, err = io.ReadAll(r)
+		return err
+	})
+
+	return shard, err
+}
+
+// repairStripe rebuilds the shards of the stripe that have no holder left out
+// of the remaining ones, and stores them on new nodes away from the shards
+// that are left. It returns the number of shards rebuilt. Only the metadata
+// node repairs stripes, which needs no key since the shards are encrypted.
+func (s *FileServer) repairStripe(st Stripe) (int, error) {
+	rs, err := newReedSolomon(st.Data, len(st.Shards)-st.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		shards  = make([][]byte, len(st.Shards))
+		missing = []int{}
+		exclude = []string{st.Owner}
+		have    = 0
+	)
+	for i, key := range st.Shards {
+		holders := s.metadata.Locate(st.Owner, key)
+		if len(holders) == 0 {
+			missing = append(missing, i)
+			continue
+		}
+		exclude = append(exclude, holders...)
+
+		if have == st.Data {
+			continue
+		}
+		shard, err := s.readShard(st.Owner, key, holders)
+		if err != nil {
+			log.Printf("[%s] reading shard (%s) failed: %s", s.Transport.Addr(), key, err)
+			continue
+		}
+		shards[i] = shard
+		have++
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	if err := rs.reconstruct(shards); err != nil {
+		return 0, fmt.Errorf("stripe (%s) has %d of %d shards left: %w", st.Key, have, len(st.Shards), err)
+	}
+
+	targets := s.placeReplicas(st.Key, exclude, len(missing))
+	if len(targets) == 0 {
+		return 0, fmt.Errorf("no node left to place the shards of (%s) on", st.Key)
+	}
+
+	rebuilt := 0
+	for j, target := range targets {
+		key := st.Shards[missing[j]]
+		if err := s.storeShard(target, st, key, shards[missing[j]]); err != nil {
+			return rebuilt, err
+		}
+
+		// The target registers the shard itself, but the next round must not
+		// see the stripe degraded in the meantime.
+		s.metadata.RegisterShard(st.Owner, key, target)
+		rebuilt++
+	}
+
+	return rebuilt, nil
+}
+
+// readShard reads the owner's shard from disk, or from one of its holders.
+func (s *FileServer) readShard(owner string, key string, holders []string) ([]byte, error) {
+	for _, id := range holders {
+		if id == s.ID {
+			_, r, err := s.store.Read(owner, key)
+			if err != nil {
+				return nil, err
+			}
+			if rc, ok := r.(io.ReadCloser); ok {
+				defer rc.Close()
+			}
+			return io.ReadAll(r)
+		}
+	}
+
+	for _, id := range holders {
+		peer, ok := s.peer(id)
+		if !ok {
+			continue
+		}
+		shard, err := s.fetchShard(context.Background(), peer, owner, key)
+		if err != nil {
+			log.Printf("[%s] fetching shard (%s) from %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		return shard, nil
+	}
+
+	return nil, fmt.Errorf("no holder of shard (%s) is connected", key)
+}
+
+// storeShard stores the shard of the stripe on the target node, which may be
+// ourselves, and waits for its verified ack.
+func (s *FileServer) storeShard(target string, st Stripe, key string, shard []byte) error {
+	owner := st.Owner
+	if target == s.ID {
+		if _, err := s.store.Write(owner, key, bytes.NewReader(shard)); err != nil {
+			return err
+		}
+		if err := s.store.SetReplica(owner, key, &st); err != nil {
+			return err
+		}
+		return s.registerShard(owner, key, &st)
+	}
+
+	peer, ok := s.peer(target)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", target)
+	}
+
+	id, replies := s.pending.add(1)
+	defer s.pending.remove(id)
+
+	msg := &Message{
+		RequestID: id,
+		Payload: MessageStoreFile{
+			ID:     owner,
+			Key:    key,
+			Size:   int64(len(shard)),
+			Shard:  true,
+			Stripe: &st,
+		},
+	}
+	checksum, err := s.streamObject(peer, msg, writeBytes(shard))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	if s.waitAcks(ctx, replies, map[string]string{target: checksum}) != 1 {
+		return fmt.Errorf("%s did not acknowledge shard (%s)", target, key)
+	}
+	return nil
+}
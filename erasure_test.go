@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFileServerErasureCoding(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.BlockSize = 1024
+		s.HeartbeatInterval = 50 * time.Millisecond
+		s.detector = newFailureDetector(150*time.Millisecond, 300*time.Millisecond)
+		s.ReplicationInterval = 100 * time.Millisecond
+	}, ":6155", ":6255", ":6355", ":6455", ":6555", ":6655", ":6755")
+	meta, owner := servers[0], servers[6]
+
+	data := bytes.Repeat([]byte("some log lines\n"), 200)
+	ec := ErasureCoding{Data: 2, Parity: 2}
+	if err := owner.StoreErasureCoded("cold.log", bytes.NewReader(data), ec); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every shard of a block is on a node of its own, and the owner keeps
+	// none of them.
+	block := blockKey("cold.log", 0)
+	if owner.store.Has(owner.ID, block) {
+		t.Errorf("the owner kept a copy of the block")
+	}
+	shardHolders := func() []string {
+		holders := []string{}
+		for i := 0; i < ec.Shards(); i++ {
+			holders = append(holders, meta.metadata.Locate(owner.ID, hashKey(shardKey(block, i)))...)
+		}
+		return holders
+	}
+	holders := shardHolders()
+	if len(holders) != ec.Shards() || len(slices.Compact(slices.Sorted(slices.Values(holders)))) != ec.Shards() {
+		t.Fatalf("want %d shards on distinct nodes have %v", ec.Shards(), holders)
+	}
+
+	get := func() {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			if err := owner.store.Delete(owner.ID, blockKey("cold.log", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		r, err := owner.Get("cold.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("want %d bytes have %d", len(data), len(b))
+		}
+	}
+	get()
+
+	// Losing as many nodes as there are parity shards loses nothing.
+	victims := []string{}
+	for _, s := range servers[1:6] {
+		if slices.Contains(holders, s.ID) && len(victims) < ec.Parity {
+			victims = append(victims, s.ID)
+			s.Stop()
+		}
+	}
+	for _, id := range victims {
+		for _, ok := owner.peer(id); ok; _, ok = owner.peer(id) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	get()
+
+	// The lost shards are rebuilt on the nodes that are left.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dead := 0
+		for _, id := range victims {
+			if st, _ := meta.PeerState(id); st == PeerDead {
+				dead++
+			}
+		}
+		st := meta.ReplicationStatus()
+		if dead == len(victims) && st.Completed > 0 && st.UnderReplicated == 0 && st.Degraded == 0 && st.InFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("shards were not rebuilt: %+v", st)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	holders = shardHolders()
+	if len(holders) != ec.Shards() {
+		t.Fatalf("want %d shards have %v", ec.Shards(), holders)
+	}
+	for i, id := range holders {
+		if slices.Contains(victims, id) {
+			t.Errorf("dead node %s still holds shard %d", id, i)
+		}
+		for _, s := range servers {
+			if s.ID == id && !s.store.Has(owner.ID, hashKey(shardKey(block, i))) {
+				t.Errorf("[%s] is a holder without a shard", s.Transport.Addr())
+			}
+		}
+	}
+
+	if err := owner.Delete("cold.log"); err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for len(meta.metadata.All()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if degraded := meta.metadata.Degraded(); len(degraded) != 0 || len(meta.metadata.All()) != 0 {
+		t.Errorf("the file outlived its deletion: %v", meta.metadata.All())
+	}
+}
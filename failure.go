@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+const (
+	defaultHeartbeatInterval = time.Second
+	// A peer is suspected after missing this many heartbeats in a row, and
+	// declared dead after missing twice as many.
+	defaultSuspectHeartbeats = 3
+)
+
+// PeerState is what the failure detector thinks of a peer.
+type PeerState int
+
+const (
+	// PeerAlive peers were heard from within the suspect timeout.
+	PeerAlive PeerState = iota
+	// PeerSuspect peers were not heard from for a while, but may still be
+	// just slow.
+	PeerSuspect
+	// PeerDead peers were not heard from within the dead timeout. They are
+	// disconnected, and come back to life once they are heard from again.
+	PeerDead
+)
+
+func (st PeerState) String() string {
+	switch st {
+	case PeerAlive:
+		return "alive"
+	case PeerSuspect:
+		return "suspect"
+	case PeerDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// MessageHeartbeat is sent to every peer each heartbeat interval. Any other
+// message from a peer counts as a heartbeat as well.
+type MessageHeartbeat struct{}
+
+// failureDetector declares a peer suspect or dead once it has not been heard
+// from for the respective timeout.
+type failureDetector struct {
+	suspectAfter time.Duration
+	deadAfter    time.Duration
+
+	lock     sync.Mutex
+	lastSeen map[string]time.Time
+	states   map[string]PeerState
+}
+
+func newFailureDetector(suspectAfter, deadAfter time.Duration) *failureDetector {
+	return &failureDetector{
+		suspectAfter: suspectAfter,
+		deadAfter:    deadAfter,
+		lastSeen:     make(map[string]time.Time),
+		states:       make(map[string]PeerState),
+	}
+}
+
+// heartbeat records that the node was heard from.
+func (d *failureDetector) heartbeat(id string, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.lastSeen[id] = now
+	d.states[id] = PeerAlive
+}
+
+// check updates the state of every node and returns the ones that just died.
+func (d *failureDetector) check(now time.Time) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	dead := []string{}
+	for id, seen := range d.lastSeen {
+		if d.states[id] == PeerDead {
+			continue
+		}
+
+		switch silent := now.Sub(seen); {
+		case silent >= d.deadAfter:
+			d.states[id] = PeerDead
+			dead = append(dead, id)
+		case silent >= d.suspectAfter:
+			d.states[id] = PeerSuspect
+		}
+	}
+
+	return dead
+}
+
+func (d *failureDetector) state(id string) (PeerState, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	st, ok := d.states[id]
+	return st, ok
+}
+
+func (d *failureDetector) snapshot() map[string]PeerState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	states := make(map[string]PeerState, len(d.states))
+	for id, st := range d.states {
+		states[id] = st
+	}
+	return states
+}
+
+// PeerState returns the state of the node with the given ID, and false if the
+// node was never connected.
+func (s *FileServer) PeerState(id string) (PeerState, bool) {
+	return s.detector.state(id)
+}
+
+// PeerStates returns the state of every node that was ever connected.
+func (s *FileServer) PeerStates() map[string]PeerState {
+	return s.detector.snapshot()
+}
+
+// OnPeerDead registers a function that is called with the ID of every node
+// the failure detector declares dead.
+func (s *FileServer) OnPeerDead(fn func(id string)) {
+	s.hookLock.Lock()
+	defer s.hookLock.Unlock()
+
+	s.deadHooks = append(s.deadHooks, fn)
+}
+
+// heartbeat sends a heartbeat to every peer each HeartbeatInterval, and
+// declares the peers that were silent for too long dead.
+func (s *FileServer) heartbeat() {
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		}
+
+		s.peerLock.Lock()
+		peers := make([]p2p.Peer, 0, len(s.peers))
+		for _, p := range s.peers {
+			peers = append(peers, p)
+		}
+		s.peerLock.Unlock()
+
+		for _, p := range peers {
+			if err := s.send(p, &Message{Payload: MessageHeartbeat{}}); err != nil {
+				log.Printf("[%s] sending heartbeat to %s failed: %s", s.Transport.Addr(), p.RemoteAddr(), err)
+			}
+		}
+
+		for _, id := range s.detector.check(time.Now()) {
+			s.peerDead(id)
+		}
+	}
+}
+
+// peerDead disconnects a node that was declared dead and runs the hooks. A
+// hung node would otherwise keep its connection forever, reconnecting gives
+// it a chance to come back.
+func (s *FileServer) peerDead(id string) {
+	log.Printf("[%s] peer %s is dead", s.Transport.Addr(), id)
+
+	if p, ok := s.peer(id); ok {
+		p.Close()
+	}
+
+	s.hookLock.Lock()
+	hooks := s.deadHooks
+	s.hookLock.Unlock()
+
+	for _, fn := range hooks {
+		fn(id)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureDetector(t *testing.T) {
+	d := newFailureDetector(3*time.Second, 6*time.Second)
+	start := time.Now()
+
+	if _, ok := d.state("node"); ok {
+		t.Fatal("unknown node has a state")
+	}
+
+	d.heartbeat("node", start)
+	for _, tt := range []struct {
+		after time.Duration
+		state PeerState
+		dies  bool
+	}{
+		{time.Second, PeerAlive, false},
+		{3 * time.Second, PeerSuspect, false},
+		{6 * time.Second, PeerDead, true},
+		{7 * time.Second, PeerDead, false},
+	} {
+		dead := d.check(start.Add(tt.after))
+		if st, _ := d.state("node"); st != tt.state {
+			t.Errorf("after %s: want %s have %s", tt.after, tt.state, st)
+		}
+		if dies := len(dead) == 1; dies != tt.dies {
+			t.Errorf("after %s: want dead %v have %v", tt.after, tt.dies, dead)
+		}
+	}
+
+	// A dead node that is heard from again is alive.
+	d.heartbeat("node", start.Add(8*time.Second))
+	if st, _ := d.state("node"); st != PeerAlive {
+		t.Errorf("want %s have %s", PeerAlive, st)
+	}
+}
+
+func TestFileServerDetectsDeadPeer(t *testing.T) {
+	servers := []*FileServer{}
+	for i, addr := range []string{":6160", ":6260"} {
+		s := makeServer(addr, []string{"", ":6160"}[i])
+		s.HeartbeatInterval = 50 * time.Millisecond
+		s.detector = newFailureDetector(150*time.Millisecond, 300*time.Millisecond)
+		servers = append(servers, s)
+
+		go s.Start()
+		time.Sleep(100 * time.Millisecond)
+	}
+	s1, s2 := servers[0], servers[1]
+	defer s1.Stop()
+	defer s1.store.Clear()
+	defer s2.store.Clear()
+
+	dead := make(chan string, 1)
+	s1.OnPeerDead(func(id string) { dead <- id })
+
+	// Heartbeats keep the peers alive well past the dead timeout.
+	time.Sleep(500 * time.Millisecond)
+	if st, ok := s1.PeerState(s2.ID); !ok || st != PeerAlive {
+		t.Fatalf("want %s have %s", PeerAlive, st)
+	}
+
+	// A stopped server keeps its connections but goes silent, like a hung
+	// node would.
+	s2.Stop()
+
+	select {
+	case id := <-dead:
+		if id != s2.ID {
+			t.Errorf("want %s declared dead have %s", s2.ID, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer was not declared dead")
+	}
+
+	if st := s1.PeerStates()[s2.ID]; st != PeerDead {
+		t.Errorf("want %s have %s", PeerDead, st)
+	}
+	if _, ok := s1.peer(s2.ID); ok {
+		t.Errorf("dead peer is still connected")
+	}
+}
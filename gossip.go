@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+const (
+	defaultGossipInterval = time.Second
+	// gossipFanout is the number of peers every gossip round is sent to.
+	gossipFanout = 3
+)
+
+// Member is what the cluster knows about a node. Members are disseminated
+// SWIM style: every gossip round a node sends its whole member list to a few
+// random peers, which merge it into theirs and answer with their own list.
+//
+// A node is the only one allowed to raise its Incarnation. It does so when it
+// hears that it is suspected or dead, which refutes the rumor everywhere.
+type Member struct {
+	p2p.Identity
+	Incarnation uint64
+	State       PeerState
+	// Decommissioning members get no new data.
+	Decommissioning bool
+}
+
+// newer reports whether m supersedes other. Newer incarnations win, within
+// the same incarnation the worse state does.
+func (m Member) newer(other Member) bool {
+	if m.Incarnation != other.Incarnation {
+		return m.Incarnation > other.Incarnation
+	}
+	return m.State > other.State
+}
+
+// MessageGossip carries the member list of the sender. Reply is set on the
+// list sent back in answer to one, which is not answered again.
+type MessageGossip struct {
+	Members []Member
+	Reply   bool
+}
+
+// membership is the member list of a node, including itself.
+type membership struct {
+	lock    sync.Mutex
+	self    string
+	members map[string]Member
+}
+
+func newMembership(self p2p.Identity) *membership {
+	return &membership{
+		self:    self.ID,
+		members: map[string]Member{self.ID: {Identity: self}},
+	}
+}
+
+// merge merges what another node knows into the list and returns the members
+// that were not known before.
+func (ms *membership) merge(members []Member) []Member {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	added := []Member{}
+	for _, m := range members {
+		if len(m.ID) == 0 {
+			continue
+		}
+
+		if m.ID == ms.self {
+			// Somebody thinks we are not alive, tell everyone otherwise.
+			self := ms.members[ms.self]
+			if m.State != PeerAlive && m.Incarnation >= self.Incarnation {
+				self.Incarnation = m.Incarnation + 1
+				ms.members[ms.self] = self
+			}
+			continue
+		}
+
+		known, ok := ms.members[m.ID]
+		if !ok {
+			added = append(added, m)
+		}
+		if !ok || m.newer(known) {
+			ms.members[m.ID] = m
+		}
+	}
+
+	return added
+}
+
+// update replaces what we advertise about ourselves.
+func (ms *membership) update(self p2p.Identity) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	m := ms.members[ms.self]
+	m.Identity = self
+	ms.members[ms.self] = m
+}
+
+// declare records what the failure detector learned about a node, within the
+// incarnation we know of.
+func (ms *membership) declare(id string, state PeerState) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	m, ok := ms.members[id]
+	if !ok || id == ms.self || m.State >= state {
+		return
+	}
+	m.State = state
+	ms.members[id] = m
+}
+
+// decommission marks ourselves as decommissioning, in a new incarnation so
+// the news supersedes what the others know.
+func (ms *membership) decommission() {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	self := ms.members[ms.self]
+	self.Incarnation++
+	self.Decommissioning = true
+	ms.members[ms.self] = self
+}
+
+func (ms *membership) decommissioning(id string) bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return ms.members[id].Decommissioning
+}
+
+// location returns the location the node advertised, if we heard of it.
+func (ms *membership) location(id string) string {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	return ms.members[id].Location
+}
+
+func (ms *membership) list() []Member {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	members := make([]Member, 0, len(ms.members))
+	for _, m := range ms.members {
+		members = append(members, m)
+	}
+	slices.SortFunc(members, func(a, b Member) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return members
+}
+
+// Members returns every node of the cluster the server knows of, including
+// itself, sorted by ID.
+func (s *FileServer) Members() []Member {
+	return s.members.list()
+}
+
+// gossip sends the member list to gossipFanout random peers every
+// GossipInterval.
+func (s *FileServer) gossip() {
+	ticker := time.NewTicker(s.GossipInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quitch:
+			return
+		}
+
+		for id, st := range s.PeerStates() {
+			if st != PeerAlive {
+				s.members.declare(id, st)
+			}
+		}
+		// Rebuild the ring right away rather than on the next placement.
+		s.currentRing()
+
+		s.peerLock.Lock()
+		peers := make([]p2p.Peer, 0, len(s.peers))
+		for _, p := range s.peers {
+			peers = append(peers, p)
+		}
+		s.peerLock.Unlock()
+
+		rand.Shuffle(len(peers), func(i, j int) {
+			peers[i], peers[j] = peers[j], peers[i]
+		})
+
+		msg := &Message{Payload: MessageGossip{Members: s.Members()}}
+		for _, p := range peers[:min(len(peers), gossipFanout)] {
+			if err := s.send(p, msg); err != nil {
+				log.Printf("[%s] gossiping with %s failed: %s", s.Transport.Addr(), p.RemoteAddr(), err)
+			}
+		}
+	}
+}
+
+func (s *FileServer) handleMessageGossip(from string, msg MessageGossip) error {
+	for _, m := range s.members.merge(msg.Members) {
+		log.Printf("[%s] discovered node %s at %s", s.Transport.Addr(), m.ID, m.ListenAddr)
+	}
+
+	// Dial every member we are not connected with yet, unless the cluster
+	// agrees it is dead.
+	for _, m := range s.Members() {
+		if m.ID == s.ID || m.State == PeerDead || len(m.ListenAddr) == 0 {
+			continue
+		}
+		if _, ok := s.peer(m.ID); !ok {
+			go s.keepConnected(m.ListenAddr)
+		}
+	}
+
+	if msg.Reply {
+		return nil
+	}
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	return s.send(peer, &Message{Payload: MessageGossip{Members: s.Members(), Reply: true}})
+}
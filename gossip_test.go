@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+func TestMembershipMerge(t *testing.T) {
+	ms := newMembership(p2p.Identity{ID: "a", ListenAddr: ":1"})
+	b := Member{Identity: p2p.Identity{ID: "b", ListenAddr: ":2"}}
+
+	if added := ms.merge([]Member{b}); len(added) != 1 {
+		t.Fatalf("want b added have %v", added)
+	}
+	if added := ms.merge([]Member{b}); len(added) != 0 {
+		t.Fatalf("want nothing added have %v", added)
+	}
+
+	// Within an incarnation the worse state wins, a newer incarnation wins
+	// regardless.
+	ms.declare("b", PeerSuspect)
+	ms.merge([]Member{b})
+	if m := ms.list()[1]; m.State != PeerSuspect {
+		t.Errorf("want %s have %s", PeerSuspect, m.State)
+	}
+	b.Incarnation = 1
+	ms.merge([]Member{b})
+	if m := ms.list()[1]; m.State != PeerAlive {
+		t.Errorf("want %s have %s", PeerAlive, m.State)
+	}
+
+	// Rumors of our own death are refuted with a newer incarnation.
+	ms.merge([]Member{{Identity: p2p.Identity{ID: "a"}, Incarnation: 3, State: PeerDead}})
+	if m := ms.list()[0]; m.State != PeerAlive || m.Incarnation != 4 || m.ListenAddr != ":1" {
+		t.Errorf("want alive at incarnation 4 have %+v", m)
+	}
+}
+
+func TestFileServerMembersBeforeStart(t *testing.T) {
+	s := makeServer(":6109")
+	t.Cleanup(func() { s.store.Clear() })
+
+	members := s.Members()
+	if len(members) != 1 || members[0].ID != s.ID {
+		t.Fatalf("want only ourselves have %+v", members)
+	}
+	if placed := s.placeOnRing("picture.png", []string{s.ID}, 1); len(placed) != 1 || placed[0] != s.ID {
+		t.Errorf("want %s have %v", s.ID, placed)
+	}
+}
+
+func TestFileServerGossipMembership(t *testing.T) {
+	// Every server only knows about the first one.
+	servers := []*FileServer{}
+	for i, addr := range []string{":6170", ":6270", ":6370"} {
+		s := makeServer(addr, []string{"", ":6170", ":6170"}[i])
+		s.GossipInterval = 50 * time.Millisecond
+		s.MetadataNode = i == 0
+		servers = append(servers, s)
+
+		go s.Start()
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Cleanup(func() {
+		for _, s := range servers {
+			s.Stop()
+			s.store.Clear()
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, s := range servers {
+		for len(s.Members()) != len(servers) || s.connectedPeers() != len(servers)-1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("[%s] knows %d members and has %d peers", s.Transport.Addr(), len(s.Members()), s.connectedPeers())
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	for _, m := range servers[2].Members() {
+		if m.State != PeerAlive {
+			t.Errorf("%s is %s", m.ID, m.State)
+		}
+		if m.ID == servers[0].ID && !m.Has(capabilityMetadata) {
+			t.Errorf("metadata capability was not gossiped")
+		}
+		if m.ID == servers[1].ID && m.ListenAddr != ":6270" {
+			t.Errorf("want %s have %s", ":6270", m.ListenAddr)
+		}
+	}
+}
+
+func (s *FileServer) connectedPeers() int {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	return len(s.peers)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const keystoreIterations = 600_000
+
+// keystoreFile is the on-disk representation of a Keystore. Every key is
+// sealed with a key derived from the passphrase, so the file alone is useless.
+type keystoreFile struct {
+	Salt       []byte
+	Iterations int
+	Current    string
+	Keys       []sealedKey
+}
+
+type sealedKey struct {
+	ID     string
+	Nonce  []byte
+	Sealed []byte
+}
+
+// Keystore persists the encryption keys of a node across restarts. The
+// current key encrypts everything new, older keys are kept around to decrypt
+// what was encrypted before a rotation.
+type Keystore struct {
+	path string
+	kek  cipher.AEAD
+	file keystoreFile
+
+	lock sync.RWMutex
+	keys map[string][]byte
+}
+
+// OpenKeystore loads the keystore at path, creating it together with a fresh
+// key if it does not exist yet.
+func OpenKeystore(path string, passphrase string) (*Keystore, error) {
+	ks := &Keystore{
+		path: path,
+		keys: make(map[string][]byte),
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		ks.file.Salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, ks.file.Salt); err != nil {
+			return nil, err
+		}
+		ks.file.Iterations = keystoreIterations
+
+		if err := ks.deriveKEK(passphrase); err != nil {
+			return nil, err
+		}
+		if _, err := ks.Rotate(); err != nil {
+			return nil, err
+		}
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&ks.file); err != nil {
+		return nil, err
+	}
+
+	if err := ks.deriveKEK(passphrase); err != nil {
+		return nil, err
+	}
+
+	for _, sk := range ks.file.Keys {
+		key, err := ks.kek.Open(nil, sk.Nonce, sk.Sealed, []byte(sk.ID))
+		if err != nil {
+			return nil, fmt.Errorf("opening keystore %s: wrong passphrase or corrupted file", path)
+		}
+		ks.keys[sk.ID] = key
+	}
+
+	return ks, nil
+}
+
+func (ks *Keystore) deriveKEK(passphrase string) error {
+	kek, err := pbkdf2.Key(sha256.New, passphrase, ks.file.Salt, ks.file.Iterations, 32)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return err
+	}
+
+	ks.kek, err = cipher.NewGCM(block)
+	return err
+}
+
+// Current returns the ID and the key new data is encrypted with.
+func (ks *Keystore) Current() (string, []byte) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	return ks.file.Current, ks.keys[ks.file.Current]
+}
+
+// Key returns the key with the given ID.
+func (ks *Keystore) Key(id string) ([]byte, error) {
+	ks.lock.RLock()
+	defer ks.lock.RUnlock()
+
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in keystore", id)
+	}
+
+	return key, nil
+}
+
+// Rotate generates a new key, persists it and makes it the current one. The
+// old keys stay available for decryption.
+func (ks *Keystore) Rotate() (string, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	key := newEncryptionKey()
+	id := encryptionKeyID(key)
+
+	nonce := make([]byte, ks.kek.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	file := ks.file
+	file.Current = id
+	file.Keys = append(append([]sealedKey{}, ks.file.Keys...), sealedKey{
+		ID:     id,
+		Nonce:  nonce,
+		Sealed: ks.kek.Seal(nil, nonce, key, []byte(id)),
+	})
+
+	if err := ks.save(file); err != nil {
+		return "", err
+	}
+
+	ks.file = file
+	ks.keys[id] = key
+
+	return id, nil
+}
+
+func (ks *Keystore) save(file keystoreFile) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(file); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ks.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := ks.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ks.path)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestKeystore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/keystore"
+
+	ks, err := OpenKeystore(path, "foo not bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, oldKey := ks.Current()
+
+	newID, err := ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == oldID {
+		t.Errorf("expected rotation to switch to a new key")
+	}
+
+	// Reopening the keystore must bring back every key.
+	ks, err = OpenKeystore(path, "foo not bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := ks.Current(); id != newID {
+		t.Errorf("want current key %s have %s", newID, id)
+	}
+	key, err := ks.Key(oldID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != string(oldKey) {
+		t.Errorf("old key changed after reopening the keystore")
+	}
+
+	if _, err := OpenKeystore(path, "bar not foo"); err == nil {
+		t.Errorf("expected opening the keystore with the wrong passphrase to fail")
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"strings"
 	"time"
 
@@ -26,17 +28,39 @@ func sanitizeRoot(listenAddr string) string {
 	return addr + "_network"
 }
 
+// keystorePassphrase returns the passphrase protecting the keystores of the
+// nodes, which has to be set in the environment. A built-in default would
+// protect nothing.
+func keystorePassphrase() (string, error) {
+	passphrase := os.Getenv("HDFS_KEYSTORE_PASSPHRASE")
+	if len(passphrase) == 0 {
+		return "", errors.New("HDFS_KEYSTORE_PASSPHRASE is not set")
+	}
+
+	return passphrase, nil
+}
+
 func makeServer(listenAddr string, nodes ...string) *FileServer {
 	tcptransportOpts := p2p.TCPTransportOpts{
-		ListenAddr:    listenAddr,
-		HandshakeFunc: p2p.NOPHandshakeFunc,
-		Decoder:       p2p.DefaultDecoder{},
+		ListenAddr: listenAddr,
+		Decoder:    p2p.DefaultDecoder{},
 	}
 	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
 
+	passphrase, err := keystorePassphrase()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	root := sanitizeRoot(listenAddr)
+	keystore, err := OpenKeystore(root+"/keystore", passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	fileServerOpts := FileServerOpts{
-		EncKey:            newEncryptionKey(),
-		StorageRoot:       sanitizeRoot(listenAddr),
+		Keystore:          keystore,
+		StorageRoot:       root,
 		PathTransformFunc: CASPathTransformFunc,
 		Transport:         tcpTransport,
 		BootstrapNodes:    nodes,
@@ -44,14 +68,17 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 
 	s := NewFileServer(fileServerOpts)
 
+	tcpTransport.HandshakeFunc = s.Handshake
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
 
 	return s
 }
 
 func main() {
 	s1 := makeServer(":3000", "")
-	s2 := makeServer(":7000", "")
+	s1.MetadataNode = true
+	s2 := makeServer(":7000", ":3000")
 	s3 := makeServer(":5000", ":3000", ":7000")
 
 	go func() { log.Fatal(s1.Start()) }()
@@ -66,11 +93,17 @@ func main() {
 	for i := 0; i < 20; i++ {
 		key := fmt.Sprintf("picture_%d.png", i)
 		data := bytes.NewReader([]byte("my big data file here!"))
-		s3.Store(key, data)
+		if err := s3.Store(key, data); err != nil {
+			log.Fatal(err)
+		}
 		time.Sleep(500 * time.Millisecond) // Allow file operations to complete
 
-		if err := s3.store.Delete(s3.ID, key); err != nil {
-			log.Fatal(err)
+		// Drop the local copies of the file so Get has to fetch them back
+		// from the network.
+		for _, k := range []string{key, blockKey(key, 0)} {
+			if err := s3.store.Delete(s3.ID, k); err != nil {
+				log.Fatal(err)
+			}
 		}
 
 		r, err := s3.Get(key)
@@ -90,4 +123,15 @@ func main() {
 
 		fmt.Println(string(b))
 	}
+
+	// Deleting through the file server removes the replicas as well, so the
+	// file can no longer be fetched from the network.
+	key := "picture_0.png"
+	if err := s3.Delete(key); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := s3.Get(key); err == nil {
+		log.Fatalf("expected (%s) to be deleted from the network", key)
+	}
 }
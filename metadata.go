@@ -0,0 +1,246 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metadata is the namespace master of the cluster. It keeps track of which
+// nodes hold a replica of which key, so clients can fetch a file from a known
+// holder instead of asking every peer.
+type Metadata struct {
+	lock      sync.RWMutex
+	locations map[string]map[string]struct{}
+	// stripes are the erasure coded blocks by owner and key, shards the
+	// owner and key of every shard. Shards outlive their stripe until they
+	// are deleted themselves, so they are never mistaken for replicas while
+	// they are being deleted.
+	stripes map[string]Stripe
+	shards  map[string]bool
+}
+
+func NewMetadata() *Metadata {
+	return &Metadata{
+		locations: make(map[string]map[string]struct{}),
+		stripes:   make(map[string]Stripe),
+		shards:    make(map[string]bool),
+	}
+}
+
+func metadataKey(owner string, key string) string {
+	return owner + "/" + key
+}
+
+// Register records that the holder node has a replica of the owner's key.
+func (m *Metadata) Register(owner string, key string, holder string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.register(owner, key, holder)
+}
+
+// RegisterShard is Register for a shard, which is never replicated.
+func (m *Metadata) RegisterShard(owner string, key string, holder string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.register(owner, key, holder)
+	m.shards[metadataKey(owner, key)] = true
+}
+
+func (m *Metadata) register(owner string, key string, holder string) {
+	k := metadataKey(owner, key)
+	if _, ok := m.locations[k]; !ok {
+		m.locations[k] = make(map[string]struct{})
+	}
+	m.locations[k][holder] = struct{}{}
+}
+
+// Unregister forgets the replica of the owner's key on the holder node. The
+// key is kept when it has no holder left, it is lost until it is deleted.
+func (m *Metadata) Unregister(owner string, key string, holder string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if holders, ok := m.locations[metadataKey(owner, key)]; ok {
+		delete(holders, holder)
+	}
+}
+
+// Forget drops the owner's key, and its stripe if it has one, once it got
+// deleted.
+func (m *Metadata) Forget(owner string, key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	k := metadataKey(owner, key)
+	delete(m.locations, k)
+	delete(m.shards, k)
+	delete(m.stripes, k)
+}
+
+// Locate returns the IDs of the nodes holding a replica of the owner's key.
+func (m *Metadata) Locate(owner string, key string) []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	holders := []string{}
+	for holder := range m.locations[metadataKey(owner, key)] {
+		holders = append(holders, holder)
+	}
+	sort.Strings(holders)
+
+	return holders
+}
+
+// Replicas is the set of nodes holding a replica of an owner's key.
+type Replicas struct {
+	Owner   string
+	Key     string
+	Holders []string
+}
+
+// DropHolder forgets every replica on the holder node, and returns the number
+// of keys that lost one. Keys without a holder left are kept as lost.
+func (m *Metadata) DropHolder(holder string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	dropped := 0
+	for _, holders := range m.locations {
+		if _, ok := holders[holder]; !ok {
+			continue
+		}
+		delete(holders, holder)
+		dropped++
+	}
+
+	return dropped
+}
+
+// UnderReplicated returns the keys that have fewer than n replicas, but at
+// least one to copy from, sorted by owner and key. Shards are never replicated
+// and are left out.
+func (m *Metadata) UnderReplicated(n int) []Replicas {
+	under := []Replicas{}
+	for _, r := range m.All() {
+		if len(r.Holders) > 0 && len(r.Holders) < n && !m.isShard(r.Owner, r.Key) {
+			under = append(under, r)
+		}
+	}
+
+	return under
+}
+
+// Lost returns the keys that have no replica left, sorted by owner and key.
+// Lost shards are left out, their stripes are Degraded.
+func (m *Metadata) Lost() []Replicas {
+	lost := []Replicas{}
+	for _, r := range m.All() {
+		if len(r.Holders) == 0 && !m.isShard(r.Owner, r.Key) {
+			lost = append(lost, r)
+		}
+	}
+
+	return lost
+}
+
+// Stripe is a block stored as erasure coded shards rather than replicated.
+// Every shard is a key of its own, held by a single node.
+type Stripe struct {
+	Owner string
+	// Key is the key of the block, Shards the keys of its shards with the
+	// Data data shards first.
+	Key    string
+	Shards []string
+	Data   int
+}
+
+// RegisterStripe records the shards the owner's block was stored as, and the
+// nodes holding them in the same order.
+func (m *Metadata) RegisterStripe(st Stripe, holders []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.stripes[metadataKey(st.Owner, st.Key)] = st
+	for i, shard := range st.Shards {
+		if i < len(holders) {
+			m.register(st.Owner, shard, holders[i])
+			m.shards[metadataKey(st.Owner, shard)] = true
+		}
+	}
+}
+
+// AddStripe records a stripe a holder reported one of the shards of, unless it
+// is known already. The metadata node keeps the stripes in memory only, so
+// this is how it learns them again after a restart.
+func (m *Metadata) AddStripe(st Stripe) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	k := metadataKey(st.Owner, st.Key)
+	if _, ok := m.stripes[k]; !ok {
+		m.stripes[k] = st
+	}
+}
+
+func (m *Metadata) isShard(owner string, key string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.shards[metadataKey(owner, key)]
+}
+
+// Degraded returns the stripes that lost a shard, sorted by owner and key.
+func (m *Metadata) Degraded() []Stripe {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	degraded := []Stripe{}
+	for _, st := range m.stripes {
+		for _, shard := range st.Shards {
+			if len(m.locations[metadataKey(st.Owner, shard)]) == 0 {
+				degraded = append(degraded, st)
+				break
+			}
+		}
+	}
+
+	sort.Slice(degraded, func(i, j int) bool {
+		if degraded[i].Owner == degraded[j].Owner {
+			return degraded[i].Key < degraded[j].Key
+		}
+		return degraded[i].Owner < degraded[j].Owner
+	})
+
+	return degraded
+}
+
+// All returns the replicas of every key, sorted by owner and key.
+func (m *Metadata) All() []Replicas {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	all := []Replicas{}
+	for k, holders := range m.locations {
+		// Node IDs never contain a slash, so the first one separates the
+		// owner from the key.
+		owner, key, _ := strings.Cut(k, "/")
+		r := Replicas{Owner: owner, Key: key}
+		for holder := range holders {
+			r.Holders = append(r.Holders, holder)
+		}
+		sort.Strings(r.Holders)
+		all = append(all, r)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Owner == all[j].Owner {
+			return all[i].Key < all[j].Key
+		}
+		return all[i].Owner < all[j].Owner
+	})
+
+	return all
+}
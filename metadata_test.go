@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	m := NewMetadata()
+	owner, key := generateID(), hashKey("momsbestpicture")
+
+	m.Register(owner, key, "node_b")
+	m.Register(owner, key, "node_a")
+	m.Register(owner, key, "node_a")
+
+	holders := m.Locate(owner, key)
+	if len(holders) != 2 || holders[0] != "node_a" || holders[1] != "node_b" {
+		t.Errorf("unexpected holders %v", holders)
+	}
+
+	if holders := m.Locate(generateID(), key); len(holders) != 0 {
+		t.Errorf("expected no holders for another owner, have %v", holders)
+	}
+
+	m.Unregister(owner, key, "node_a")
+	m.Unregister(owner, key, "node_b")
+
+	if holders := m.Locate(owner, key); len(holders) != 0 {
+		t.Errorf("expected no holders after unregistering, have %v", holders)
+	}
+	if lost := m.Lost(); len(lost) != 1 || lost[0].Key != key {
+		t.Errorf("expected the key to be lost, have %v", lost)
+	}
+
+	m.Forget(owner, key)
+	if all := m.All(); len(all) != 0 {
+		t.Errorf("expected the key to be forgotten, have %v", all)
+	}
+}
+
+func TestMetadataUnderReplicated(t *testing.T) {
+	m := NewMetadata()
+	owner := generateID()
+
+	for _, holder := range []string{"node_a", "node_b"} {
+		m.Register(owner, "full", holder)
+	}
+	m.Register(owner, "lonely", "node_a")
+	m.Register(owner, "lost", "node_c")
+
+	if under := m.UnderReplicated(2); len(under) != 2 || under[0].Key != "lonely" || under[0].Owner != owner {
+		t.Errorf("unexpected under replicated keys %v", under)
+	}
+
+	if dropped := m.DropHolder("node_a"); dropped != 2 {
+		t.Errorf("want 2 keys dropped have %d", dropped)
+	}
+	if dropped := m.DropHolder("node_c"); dropped != 1 {
+		t.Errorf("want 1 key dropped have %d", dropped)
+	}
+
+	// A key without any replica left cannot be restored anymore, it is
+	// reported as lost instead.
+	under := m.UnderReplicated(2)
+	if len(under) != 1 || under[0].Key != "full" || len(under[0].Holders) != 1 || under[0].Holders[0] != "node_b" {
+		t.Errorf("unexpected under replicated keys %v", under)
+	}
+	if lost := m.Lost(); len(lost) != 2 || lost[0].Key != "lonely" || lost[1].Key != "lost" {
+		t.Errorf("unexpected lost keys %v", lost)
+	}
+}
+
+func TestMetadataStripes(t *testing.T) {
+	m := NewMetadata()
+	owner := generateID()
+
+	// Shards may register before their stripe.
+	m.RegisterShard(owner, "shard0", "node_a")
+	if under := m.UnderReplicated(2); len(under) != 0 {
+		t.Errorf("unexpected under replicated keys %v", under)
+	}
+	m.RegisterStripe(Stripe{Owner: owner, Key: "block", Shards: []string{"shard0", "shard1", "shard2"}, Data: 2}, []string{"node_a", "node_b", "node_c"})
+	if holders := m.Locate(owner, "shard2"); len(holders) != 1 || holders[0] != "node_c" {
+		t.Errorf("unexpected holders %v", holders)
+	}
+
+	// Shards have a single holder on purpose.
+	if under := m.UnderReplicated(2); len(under) != 0 {
+		t.Errorf("unexpected under replicated keys %v", under)
+	}
+	if degraded := m.Degraded(); len(degraded) != 0 {
+		t.Errorf("unexpected degraded stripes %v", degraded)
+	}
+
+	m.DropHolder("node_b")
+	if degraded := m.Degraded(); len(degraded) != 1 || degraded[0].Key != "block" {
+		t.Errorf("unexpected degraded stripes %v", degraded)
+	}
+
+	if lost := m.Lost(); len(lost) != 0 {
+		t.Errorf("unexpected lost keys %v", lost)
+	}
+
+	m.Forget(owner, "block")
+	if degraded := m.Degraded(); len(degraded) != 0 {
+		t.Errorf("unexpected degraded stripes %v", degraded)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobStore holds the contents of the files in a Namespace. The FileServer
+// implements it, so blobs keep living in the content addressable layout of
+// the Store.
+type BlobStore interface {
+	Store(key string, r io.Reader) error
+	Get(key string) (io.Reader, error)
+	Delete(key string) error
+}
+
+// ErasureCodedBlobStore is a BlobStore that can also store blobs erasure
+// coded, as the FileServer does. Namespaces need one for directories and
+// files that are erasure coded.
+type ErasureCodedBlobStore interface {
+	BlobStore
+	StoreErasureCoded(key string, r io.Reader, ec ErasureCoding) error
+}
+
+// Entry is a file or directory in the namespace.
+type Entry struct {
+	Path  string
+	IsDir bool
+	// Key is the blob key holding the contents of a file. It is random and
+	// not derived from the path, so renaming never has to touch the blob.
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// ErasureCoding is how a file is stored, nil if it is replicated. On a
+	// directory it is how the files created below it are stored, unless a
+	// directory further down has one of its own.
+	ErasureCoding *ErasureCoding
+}
+
+type NamespaceOpts struct {
+	// Path is the file the namespace is persisted to after every change.
+	Path  string
+	Blobs BlobStore
+}
+
+// Namespace is a hierarchical view of directories and files on top of the
+// flat keys of a BlobStore.
+type Namespace struct {
+	NamespaceOpts
+
+	lock    sync.RWMutex
+	entries map[string]*Entry
+}
+
+func NewNamespace(opts NamespaceOpts) (*Namespace, error) {
+	ns := &Namespace{
+		NamespaceOpts: opts,
+		entries:       make(map[string]*Entry),
+	}
+
+	if err := ns.load(); err != nil {
+		return nil, err
+	}
+
+	if _, ok := ns.entries["/"]; !ok {
+		ns.entries["/"] = &Entry{Path: "/", IsDir: true, ModTime: time.Now()}
+	}
+
+	return ns, nil
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// isBelow reports whether p is dir itself or lives somewhere below it.
+func isBelow(p string, dir string) bool {
+	if dir == "/" || p == dir {
+		return true
+	}
+	return strings.HasPrefix(p, dir+"/")
+}
+
+// Mkdir creates the directory together with any missing parents.
+func (ns *Namespace) Mkdir(p string) error {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	return ns.update(func(entries map[string]*Entry) error {
+		return mkdirAll(entries, cleanPath(p))
+	})
+}
+
+func mkdirAll(entries map[string]*Entry, p string) error {
+	if e, ok := entries[p]; ok {
+		if !e.IsDir {
+			return fmt.Errorf("mkdir %s: %w", p, fs.ErrExist)
+		}
+		return nil
+	}
+
+	if err := mkdirAll(entries, path.Dir(p)); err != nil {
+		return err
+	}
+
+	entries[p] = &Entry{Path: p, IsDir: true, ModTime: time.Now()}
+
+	return nil
+}
+
+// Create stores the contents of r as a new file at the given path, creating
+// missing parent directories. An existing file at the path is replaced. The
+// file is erasure coded if the closest directory above it with an erasure
+// coding says so.
+func (ns *Namespace) Create(p string, r io.Reader) error {
+	return ns.create(p, r, nil)
+}
+
+// CreateErasureCoded is Create with the file erasure coded as ec says,
+// whatever its directory says.
+func (ns *Namespace) CreateErasureCoded(p string, r io.Reader, ec ErasureCoding) error {
+	if err := ec.validate(); err != nil {
+		return err
+	}
+	return ns.create(p, r, &ec)
+}
+
+func (ns *Namespace) create(p string, r io.Reader, ec *ErasureCoding) error {
+	p = cleanPath(p)
+
+	// The blob is uploaded without holding the lock, which would keep every
+	// other operation waiting for as long as the upload takes.
+	ns.lock.RLock()
+	err := ns.canCreate(p)
+	if ec == nil {
+		ec = ns.inheritedErasureCoding(path.Dir(p))
+	}
+	ns.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	cr := &countingReader{r: r}
+	key := generateID()
+	if err := ns.storeBlob(key, cr, ec); err != nil {
+		return err
+	}
+
+	ns.lock.Lock()
+
+	// A directory may have shown up at the path, or at one of its parents,
+	// in the meantime.
+	var old *Entry
+	err = ns.canCreate(p)
+	if err == nil {
+		err = ns.update(func(entries map[string]*Entry) error {
+			if err := mkdirAll(entries, path.Dir(p)); err != nil {
+				return err
+			}
+			old = entries[p]
+			entries[p] = &Entry{Path: p, Key: key, Size: cr.n, ModTime: time.Now(), ErasureCoding: ec}
+			return nil
+		})
+	}
+	ns.lock.Unlock()
+	if err != nil {
+		return errors.Join(err, ns.Blobs.Delete(key))
+	}
+
+	if old != nil {
+		return ns.Blobs.Delete(old.Key)
+	}
+
+	return nil
+}
+
+// canCreate returns an error if a file cannot be created at the path because
+// the path, or one of its parents, is taken by something else.
+func (ns *Namespace) canCreate(p string) error {
+	if e, ok := ns.entries[p]; ok && e.IsDir {
+		return fmt.Errorf("create %s: is a directory", p)
+	}
+
+	for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+		if e, ok := ns.entries[dir]; ok && !e.IsDir {
+			return fmt.Errorf("create %s: %s is not a directory", p, dir)
+		}
+	}
+
+	return nil
+}
+
+func (ns *Namespace) storeBlob(key string, r io.Reader, ec *ErasureCoding) error {
+	if ec == nil {
+		return ns.Blobs.Store(key, r)
+	}
+
+	blobs, ok := ns.Blobs.(ErasureCodedBlobStore)
+	if !ok {
+		return fmt.Errorf("blob store cannot store %s erasure coded blobs", ec)
+	}
+	return blobs.StoreErasureCoded(key, r, *ec)
+}
+
+// SetErasureCoding makes the files created below the directory from now on
+// erasure coded as ec says. With ec nil they are stored as the directories
+// above say again. Files that exist already are left as they are.
+func (ns *Namespace) SetErasureCoding(dir string, ec *ErasureCoding) error {
+	dir = cleanPath(dir)
+
+	if ec != nil {
+		if err := ec.validate(); err != nil {
+			return err
+		}
+	}
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	return ns.update(func(entries map[string]*Entry) error {
+		e, ok := entries[dir]
+		if !ok || !e.IsDir {
+			return fmt.Errorf("set erasure coding of %s: %w", dir, fs.ErrNotExist)
+		}
+		e.ErasureCoding = ec
+		return nil
+	})
+}
+
+// inheritedErasureCoding returns the erasure coding of the closest directory
+// at or above dir that has one.
+func (ns *Namespace) inheritedErasureCoding(dir string) *ErasureCoding {
+	for {
+		if e, ok := ns.entries[dir]; ok && e.ErasureCoding != nil {
+			return e.ErasureCoding
+		}
+		if dir == "/" {
+			return nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// Open returns the contents of the file at the given path.
+func (ns *Namespace) Open(p string) (io.Reader, error) {
+	e, err := ns.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if e.IsDir {
+		return nil, fmt.Errorf("open %s: is a directory", e.Path)
+	}
+
+	return ns.Blobs.Get(e.Key)
+}
+
+func (ns *Namespace) Stat(p string) (Entry, error) {
+	p = cleanPath(p)
+
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+
+	e, ok := ns.entries[p]
+	if !ok {
+		return Entry{}, fmt.Errorf("stat %s: %w", p, fs.ErrNotExist)
+	}
+
+	return *e, nil
+}
+
+// List returns every entry below the given directory, sorted by path.
+func (ns *Namespace) List(prefix string) ([]Entry, error) {
+	dir := cleanPath(prefix)
+
+	ns.lock.RLock()
+	defer ns.lock.RUnlock()
+
+	if e, ok := ns.entries[dir]; !ok || !e.IsDir {
+		return nil, fmt.Errorf("list %s: %w", dir, fs.ErrNotExist)
+	}
+
+	entries := []Entry{}
+	for p, e := range ns.entries {
+		if p != dir && isBelow(p, dir) {
+			entries = append(entries, *e)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	return entries, nil
+}
+
+// Rename moves a file or a whole directory tree to a new path. Only the
+// namespace changes, the blobs are left where they are.
+func (ns *Namespace) Rename(from string, to string) error {
+	from, to = cleanPath(from), cleanPath(to)
+
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+
+	return ns.update(func(entries map[string]*Entry) error {
+		if _, ok := entries[from]; !ok || from == "/" {
+			return fmt.Errorf("rename %s: %w", from, fs.ErrNotExist)
+		}
+		if _, ok := entries[to]; ok {
+			return fmt.Errorf("rename %s: %w", to, fs.ErrExist)
+		}
+		if isBelow(to, from) {
+			return fmt.Errorf("rename %s to %s: cannot move a directory into itself", from, to)
+		}
+
+		if err := mkdirAll(entries, path.Dir(to)); err != nil {
+			return err
+		}
+
+		moved := []*Entry{}
+		for p, e := range entries {
+			if isBelow(p, from) {
+				moved = append(moved, e)
+				delete(entries, p)
+			}
+		}
+		for _, e := range moved {
+			e.Path = to + strings.TrimPrefix(e.Path, from)
+			entries[e.Path] = e
+		}
+
+		return nil
+	})
+}
+
+// Delete removes the file or directory at the given path. Directories that
+// are not empty are only removed when recursive is set.
+func (ns *Namespace) Delete(p string, recursive bool) error {
+	p = cleanPath(p)
+
+	ns.lock.Lock()
+	deleted := []*Entry{}
+	err := ns.update(func(entries map[string]*Entry) error {
+		e, ok := entries[p]
+		if !ok || p == "/" {
+			return fmt.Errorf("delete %s: %w", p, fs.ErrNotExist)
+		}
+
+		for child, ce := range entries {
+			if isBelow(child, p) {
+				deleted = append(deleted, ce)
+			}
+		}
+		if e.IsDir && len(deleted) > 1 && !recursive {
+			return fmt.Errorf("delete %s: directory not empty", p)
+		}
+
+		for _, de := range deleted {
+			delete(entries, de.Path)
+		}
+		return nil
+	})
+	ns.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The blobs are deleted without holding the lock, which would keep every
+	// other operation waiting for as long as the deletes take.
+	var errs []error
+	for _, de := range deleted {
+		if !de.IsDir {
+			errs = append(errs, ns.Blobs.Delete(de.Key))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (ns *Namespace) load() error {
+	if len(ns.Path) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(ns.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewDecoder(f).Decode(&ns.entries)
+}
+
+// update has change change a copy of the entries, which only replaces them
+// once it was saved. A change that fails, or that cannot be saved, leaves the
+// namespace as it was. The caller holds the lock.
+func (ns *Namespace) update(change func(entries map[string]*Entry) error) error {
+	entries := make(map[string]*Entry, len(ns.entries))
+	for p, e := range ns.entries {
+		c := *e
+		entries[p] = &c
+	}
+
+	if err := change(entries); err != nil {
+		return err
+	}
+	if err := ns.save(entries); err != nil {
+		return err
+	}
+
+	ns.entries = entries
+	return nil
+}
+
+// save persists the entries by writing them to a temporary file that then
+// replaces the old one, so a crash never leaves a half written namespace.
+func (ns *Namespace) save(entries map[string]*Entry) error {
+	if len(ns.Path) == 0 {
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(entries); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ns.Path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := ns.Path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, ns.Path)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
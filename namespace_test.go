@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+type memBlobStore struct {
+	blobs map[string][]byte
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (m *memBlobStore) Store(key string, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.blobs[key] = b
+	return nil
+}
+
+func (m *memBlobStore) Get(key string) (io.Reader, error) {
+	b, ok := m.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("blob %s: %w", key, fs.ErrNotExist)
+	}
+	return bytes.NewReader(b), nil
+}
+
+func (m *memBlobStore) Delete(key string) error {
+	delete(m.blobs, key)
+	return nil
+}
+
+func TestNamespace(t *testing.T) {
+	dir, err := os.MkdirTemp("", "namespace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blobs := newMemBlobStore()
+	opts := NamespaceOpts{
+		Path:  dir + "/namespace",
+		Blobs: blobs,
+	}
+
+	ns, err := NewNamespace(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ns.Mkdir("/logs/2026"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		p := fmt.Sprintf("/logs/2026/day_%d.log", i)
+		if err := ns.Create(p, bytes.NewReader([]byte("some log lines"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ns.Create("/logs/2025/day_0.log", bytes.NewReader([]byte("old"))); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ns.List("/logs/2026/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("want 3 entries under /logs/2026 have %d", len(entries))
+	}
+
+	e, err := ns.Stat("/logs/2026/day_1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.IsDir || e.Size != int64(len("some log lines")) {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	if err := ns.Rename("/logs/2026", "/archive/2026"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Stat("/logs/2026/day_1.log"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the old path to be gone, have %v", err)
+	}
+	moved, err := ns.Stat("/archive/2026/day_1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Key != e.Key {
+		t.Errorf("rename should keep the blob, have key %s want %s", moved.Key, e.Key)
+	}
+
+	// The namespace must survive a restart.
+	ns, err = NewNamespace(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ns.Open("/archive/2026/day_1.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if string(b) != "some log lines" {
+		t.Errorf("want %s have %s", "some log lines", b)
+	}
+
+	if err := ns.Delete("/archive", false); err == nil {
+		t.Errorf("expected deleting a non empty directory to fail")
+	}
+	if err := ns.Delete("/archive", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs.blobs) != 1 {
+		t.Errorf("want 1 blob left after the recursive delete have %d", len(blobs.blobs))
+	}
+}
+
+// ecBlobStore records how every blob was erasure coded.
+type ecBlobStore struct {
+	*memBlobStore
+	coded map[string]ErasureCoding
+}
+
+func (e *ecBlobStore) StoreErasureCoded(key string, r io.Reader, ec ErasureCoding) error {
+	e.coded[key] = ec
+	return e.Store(key, r)
+}
+
+func TestNamespaceErasureCoding(t *testing.T) {
+	blobs := &ecBlobStore{memBlobStore: newMemBlobStore(), coded: make(map[string]ErasureCoding)}
+	ns, err := NewNamespace(NamespaceOpts{Blobs: blobs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cold := &ErasureCoding{Data: 6, Parity: 3}
+	if err := ns.Mkdir("/cold/2025"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.SetErasureCoding("/cold", cold); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.SetErasureCoding("/cold/missing", cold); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want %v have %v", fs.ErrNotExist, err)
+	}
+
+	create := func(p string) Entry {
+		if err := ns.Create(p, bytes.NewReader([]byte("some log lines"))); err != nil {
+			t.Fatal(err)
+		}
+		e, err := ns.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	// Files below the directory inherit its erasure coding.
+	e := create("/cold/2025/day_0.log")
+	if e.ErasureCoding == nil || *e.ErasureCoding != *cold || blobs.coded[e.Key] != *cold {
+		t.Errorf("want %s have %v", cold, e.ErasureCoding)
+	}
+	if e := create("/hot/day_0.log"); e.ErasureCoding != nil {
+		t.Errorf("want a replicated file have %s", e.ErasureCoding)
+	}
+
+	// A single file can be erasure coded on its own.
+	if err := ns.CreateErasureCoded("/hot/big.log", bytes.NewReader([]byte("big")), ErasureCoding{Data: 2, Parity: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := ns.Stat("/hot/big.log"); blobs.coded[e.Key] != (ErasureCoding{Data: 2, Parity: 1}) {
+		t.Errorf("unexpected erasure coding %v", blobs.coded[e.Key])
+	}
+
+	if err := ns.SetErasureCoding("/cold", nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := create("/cold/2025/day_1.log"); e.ErasureCoding != nil {
+		t.Errorf("want a replicated file have %s", e.ErasureCoding)
+	}
+
+	// Blob stores that cannot erasure code refuse.
+	plain, err := NewNamespace(NamespaceOpts{Blobs: newMemBlobStore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.CreateErasureCoded("/big.log", bytes.NewReader([]byte("big")), *cold); err == nil {
+		t.Errorf("expected the erasure coded file to be refused")
+	}
+}
+
+func TestNamespaceCreateUploadsWithoutTheLock(t *testing.T) {
+	blobs := newMemBlobStore()
+	ns, err := NewNamespace(NamespaceOpts{Blobs: blobs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- ns.Create("/upload/big.bin", pr) }()
+
+	// The upload is under way once it took the first bytes.
+	if _, err := pw.Write([]byte("some bytes")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The namespace keeps serving meanwhile, and a directory takes the path.
+	if _, err := ns.List("/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Mkdir("/upload/big.bin"); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+
+	if err := <-done; err == nil {
+		t.Fatal("expected Create to fail on the directory created during the upload")
+	}
+	if len(blobs.blobs) != 0 {
+		t.Errorf("the uploaded blob was left behind")
+	}
+	if e, err := ns.Stat("/upload/big.bin"); err != nil || !e.IsDir {
+		t.Errorf("expected a directory at /upload/big.bin, have %+v %v", e, err)
+	}
+}
+
+func TestNamespaceKeepsEntriesWhenSaveFails(t *testing.T) {
+	dir := t.TempDir()
+
+	blobs := newMemBlobStore()
+	ns, err := NewNamespace(NamespaceOpts{Path: dir + "/namespace", Blobs: blobs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Create("/docs/a.txt", bytes.NewReader([]byte("some text"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The namespace cannot be saved below a file.
+	ns.Path = dir + "/namespace/namespace"
+
+	if err := ns.Rename("/docs", "/moved"); err == nil {
+		t.Fatal("expected Rename to fail")
+	}
+	if err := ns.Delete("/docs", true); err == nil {
+		t.Fatal("expected Delete to fail")
+	}
+	if err := ns.Create("/docs/b.txt", bytes.NewReader([]byte("more text"))); err == nil {
+		t.Fatal("expected Create to fail")
+	}
+
+	entries, err := ns.List("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Path != "/docs" || entries[1].Path != "/docs/a.txt" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	if _, err := ns.Open("/docs/a.txt"); err != nil {
+		t.Errorf("the blob of a file that was not deleted is gone: %s", err)
+	}
+	if len(blobs.blobs) != 1 {
+		t.Errorf("want 1 blob have %d", len(blobs.blobs))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 )
 
+// Decoder decodes the payload of a message frame into an RPC.
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
@@ -15,29 +16,16 @@ func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
 	return gob.NewDecoder(r).Decode(msg)
 }
 
+// DefaultDecoder takes the payload of a message frame as it is.
 type DefaultDecoder struct{}
 
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
-	}
-
-	// In case of a stream we are not decoding what is being sent over the network.
-	// We are just setting Stream true so we can handle that in our logic.
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		msg.Stream = true
-		return nil
-	}
-
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
+	payload, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	msg.Payload = payload
 
 	return nil
 }
@@ -0,0 +1,159 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Everything sent over a connection after the handshake is a frame. A frame
+// starts with a header of FrameHeaderSize bytes:
+//
+//	type    1 byte   one of the frame types below
+//	flags   1 byte   flagOpen and flagEnd on stream frames, zero otherwise
+//	length  8 bytes  big endian, the number of payload bytes after the header
+//	ID      8 bytes  big endian, the request ID of a message or the ID of the
+//	                 stream the frame belongs to
+//
+// IncomingMessage frames carry a whole message. IncomingStream frames carry the
+// next chunk of a stream. frameWindowUpdate frames grant the sender of a
+// stream more room, their payload is the 4 byte big endian increment.
+// frameReset frames abort a stream and have no payload.
+const FrameHeaderSize = 1 + 1 + 8 + 8
+
+const (
+	frameWindowUpdate = 0x3
+	frameReset        = 0x4
+)
+
+const (
+	// flagOpen marks the first frame of a stream.
+	flagOpen = 0x1
+	// flagEnd marks the last frame a side sends on a stream.
+	flagEnd = 0x2
+)
+
+// MaxMessageSize bounds the payload of a message frame, so a peer cannot make
+// us allocate arbitrary amounts of memory. Bulk data goes into streams.
+const MaxMessageSize = 16 << 20
+
+// maxDataSize bounds the payload of a stream frame, so a single stream cannot
+// hog the connection for long.
+const maxDataSize = 32 * 1024
+
+var errFrameTooLarge = errors.New("message frame exceeds MaxMessageSize")
+
+type FrameHeader struct {
+	Type  byte
+	Flags byte
+	// Length is the size of the payload following the header.
+	Length uint64
+	// ID is the request ID of a message frame and the stream ID of any other
+	// frame.
+	ID uint64
+}
+
+func (h FrameHeader) appendTo(b []byte) []byte {
+	b = append(b, h.Type, h.Flags)
+	b = binary.BigEndian.AppendUint64(b, h.Length)
+	return binary.BigEndian.AppendUint64(b, h.ID)
+}
+
+// Frame is a frame header together with its payload.
+type Frame struct {
+	FrameHeader
+	Payload []byte
+}
+
+// ReadFrameHeader reads and validates the next frame header from r.
+func ReadFrameHeader(r io.Reader) (FrameHeader, error) {
+	var (
+		h   FrameHeader
+		buf = make([]byte, FrameHeaderSize)
+	)
+
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return h, err
+	}
+
+	h.Type = buf[0]
+	h.Flags = buf[1]
+	h.Length = binary.BigEndian.Uint64(buf[2:10])
+	h.ID = binary.BigEndian.Uint64(buf[10:18])
+
+	switch h.Type {
+	case IncomingMessage:
+		if h.Length > MaxMessageSize {
+			return h, errFrameTooLarge
+		}
+	case IncomingStream:
+		if h.Length > maxDataSize {
+			return h, fmt.Errorf("stream frame of %d bytes exceeds %d bytes", h.Length, maxDataSize)
+		}
+		if h.Flags&^(flagOpen|flagEnd) != 0 {
+			return h, fmt.Errorf("unknown frame flags 0x%x", h.Flags)
+		}
+		return h, nil
+	case frameWindowUpdate:
+		if h.Length != 4 {
+			return h, fmt.Errorf("window update frame of %d bytes", h.Length)
+		}
+	case frameReset:
+		if h.Length != 0 {
+			return h, fmt.Errorf("reset frame of %d bytes", h.Length)
+		}
+	default:
+		return h, fmt.Errorf("unknown frame type 0x%x", h.Type)
+	}
+
+	if h.Flags != 0 {
+		return h, fmt.Errorf("unknown frame flags 0x%x", h.Flags)
+	}
+
+	return h, nil
+}
+
+// ReadFrame reads the next frame from r, however it is split over TCP
+// segments.
+func ReadFrame(r io.Reader) (Frame, error) {
+	h, err := ReadFrameHeader(r)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	// Grow the buffer as the payload arrives rather than trusting the length
+	// up front, so a peer cannot claim a large payload it never sends.
+	buf := bytes.NewBuffer(make([]byte, 0, min(h.Length, 64*1024)))
+	if _, err := io.CopyN(buf, r, int64(h.Length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+
+	return Frame{FrameHeader: h, Payload: buf.Bytes()}, nil
+}
+
+func (f Frame) appendTo(b []byte) []byte {
+	f.Length = uint64(len(f.Payload))
+	return append(f.FrameHeader.appendTo(b), f.Payload...)
+}
+
+// encodeMessage returns the frame carrying the payload as a message.
+func encodeMessage(requestID uint64, payload []byte) ([]byte, error) {
+	if len(payload) > MaxMessageSize {
+		return nil, errFrameTooLarge
+	}
+
+	f := Frame{
+		FrameHeader: FrameHeader{
+			Type: IncomingMessage,
+			ID:   requestID,
+		},
+		Payload: payload,
+	}
+
+	return f.appendTo(make([]byte, 0, FrameHeaderSize+len(payload))), nil
+}
@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadFrame(t *testing.T) {
+	large := bytes.Repeat([]byte("foo not bar"), 1000)
+
+	wire := new(bytes.Buffer)
+	for _, payload := range [][]byte{[]byte("small"), large, {}} {
+		b, err := encodeMessage(42, payload)
+		require.Nil(t, err)
+		wire.Write(b)
+	}
+	wire.Write(Frame{
+		FrameHeader: FrameHeader{Type: IncomingStream, Flags: flagOpen | flagEnd, ID: 3},
+		Payload:     []byte("abc"),
+	}.appendTo(nil))
+
+	// Hand out a single byte per read, as if every byte arrived in a TCP
+	// segment of its own.
+	r := iotest.OneByteReader(wire)
+
+	for _, want := range [][]byte{[]byte("small"), large, {}} {
+		f, err := ReadFrame(r)
+		require.Nil(t, err)
+		assert.Equal(t, byte(IncomingMessage), f.Type)
+		assert.Equal(t, uint64(42), f.ID)
+		assert.Equal(t, want, f.Payload)
+	}
+
+	f, err := ReadFrame(r)
+	require.Nil(t, err)
+	assert.Equal(t, byte(IncomingStream), f.Type)
+	assert.Equal(t, uint64(3), f.ID)
+	assert.Equal(t, "abc", string(f.Payload))
+
+	_, err = ReadFrame(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestReadFrameRejectsBadFrames(t *testing.T) {
+	for name, b := range map[string][]byte{
+		"unknown type":         FrameHeader{Type: 0x7}.appendTo(nil),
+		"unknown flags":        FrameHeader{Type: IncomingMessage, Flags: flagEnd}.appendTo(nil),
+		"unknown stream flags": FrameHeader{Type: IncomingStream, Flags: 0x4}.appendTo(nil),
+		"message too large":    FrameHeader{Type: IncomingMessage, Length: MaxMessageSize + 1}.appendTo(nil),
+		"stream too large":     FrameHeader{Type: IncomingStream, Length: maxDataSize + 1}.appendTo(nil),
+		"bad window update":    FrameHeader{Type: frameWindowUpdate, Length: 8}.appendTo(nil),
+		"short header":         FrameHeader{Type: IncomingMessage}.appendTo(nil)[:5],
+		"short payload":        FrameHeader{Type: IncomingMessage, Length: 10}.appendTo(nil),
+		"empty":                {},
+	} {
+		_, err := ReadFrame(bytes.NewReader(b))
+		assert.NotNil(t, err, name)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	b, _ := encodeMessage(1, []byte("foo not bar"))
+	f.Add(b)
+	f.Add(FrameHeader{Type: IncomingStream, Flags: flagOpen, Length: 1 << 40}.appendTo(nil))
+	f.Add(FrameHeader{Type: IncomingMessage, Length: MaxMessageSize}.appendTo(nil))
+	f.Add(FrameHeader{Type: frameWindowUpdate, Length: 4}.appendTo(nil))
+	f.Add([]byte{IncomingMessage})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bytes.NewReader(b)
+
+		for read := 0; ; {
+			f, err := ReadFrame(r)
+			if err != nil {
+				return
+			}
+
+			// A frame can never claim more bytes than were on the wire.
+			read += FrameHeaderSize + len(f.Payload)
+			if read > len(b) {
+				t.Fatalf("decoded %d bytes out of %d bytes", read, len(b))
+			}
+			if uint64(len(f.Payload)) != f.Length {
+				t.Fatalf("frame of length %d has %d bytes of payload", f.Length, len(f.Payload))
+			}
+		}
+	})
+}
+
+func FuzzEncodeMessage(f *testing.F) {
+	f.Add(uint64(0), []byte{})
+	f.Add(uint64(7), []byte("foo not bar"))
+
+	f.Fuzz(func(t *testing.T, requestID uint64, payload []byte) {
+		b, err := encodeMessage(requestID, payload)
+		require.Nil(t, err)
+
+		f, err := ReadFrame(bytes.NewReader(b))
+		require.Nil(t, err)
+		assert.Equal(t, requestID, f.ID)
+		assert.True(t, bytes.Equal(payload, f.Payload))
+	})
+}
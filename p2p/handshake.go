@@ -1,5 +1,166 @@
 package p2p
 
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+// ProtocolVersion is the version of the wire protocol spoken by this package.
+// Peers speaking another version are rejected during the handshake.
+const ProtocolVersion = 2
+
+const (
+	handshakeTimeout = 5 * time.Second
+	// maxHelloSize bounds what a remote can make us allocate before it
+	// identified itself.
+	maxHelloSize = 64 * 1024
+)
+
 type HandshakeFunc func(Peer) error
 
-func NOPHandshakeFunc(Peer) error { return nil }
\ No newline at end of file
+func NOPHandshakeFunc(Peer) error { return nil }
+
+// Identity is what a node tells about itself during the handshake.
+type Identity struct {
+	// ID is the node ID, which stays the same for every connection to the
+	// node, unlike its remote address.
+	ID string
+	// ListenAddr is the address the node accepts connections on.
+	ListenAddr   string
+	Capabilities []string
+	// Location is where the node sits in the network, a path like
+	// /zone/rack/host. Nodes on different branches fail independently.
+	Location string
+}
+
+// Has reports whether the node advertised the capability.
+func (id Identity) Has(capability string) bool {
+	return slices.Contains(id.Capabilities, capability)
+}
+
+// hello is the first (and only) message both sides of a connection send each
+// other before anything else goes over the wire.
+type hello struct {
+	Version uint32
+	Identity
+}
+
+// IdentityHandshakeFunc returns a HandshakeFunc that identifies the local node
+// as local. See Handshake.
+func IdentityHandshakeFunc(local Identity) HandshakeFunc {
+	return func(p Peer) error {
+		return Handshake(p, local)
+	}
+}
+
+// identifiedPeer is implemented by the peers of this package, so Handshake can
+// record the identity it learned.
+type identifiedPeer interface {
+	setIdentity(Identity)
+	// certifiedID returns the node ID the peer proved to own with its TLS
+	// certificate, or an empty string if it did not use one.
+	certifiedID() string
+	// conn returns the connection of the peer, which the handshake reads from
+	// before the read loop takes over.
+	conn() net.Conn
+}
+
+// Handshake sends our identity to the peer and reads the identity of the peer
+// in turn, which is made available through Peer.Identity afterwards. Peers that
+// speak another protocol version, do not identify themselves, claim to be the
+// local node, present a certificate without a node ID or claim another node ID
+// than their certificate was issued for are rejected.
+func Handshake(p Peer, local Identity) error {
+	ip, ok := p.(identifiedPeer)
+	if !ok {
+		return fmt.Errorf("handshake: unsupported peer type %T", p)
+	}
+
+	conn := ip.conn()
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	// Both sides send first, so neither of them waits for the other.
+	errch := make(chan error, 1)
+	go func() {
+		errch <- writeHello(conn, hello{Version: ProtocolVersion, Identity: local})
+	}()
+
+	remote, err := readHello(conn)
+	if werr := <-errch; err == nil {
+		err = werr
+	}
+	if err != nil {
+		return fmt.Errorf("handshake with %s: %w", p.RemoteAddr(), err)
+	}
+
+	switch {
+	case remote.Version != ProtocolVersion:
+		return fmt.Errorf("handshake with %s: incompatible protocol version %d, we speak %d", p.RemoteAddr(), remote.Version, ProtocolVersion)
+	case len(remote.ID) == 0:
+		return fmt.Errorf("handshake with %s: remote did not send a node ID", p.RemoteAddr())
+	case remote.ID == local.ID:
+		return fmt.Errorf("handshake with %s: remote claims our own node ID", p.RemoteAddr())
+	case isTLS(conn) && len(ip.certifiedID()) == 0:
+		return fmt.Errorf("handshake with %s: remote certificate carries no node ID", p.RemoteAddr())
+	case len(ip.certifiedID()) > 0 && remote.ID != ip.certifiedID():
+		return fmt.Errorf("handshake with %s: remote claims node ID %s but its certificate is issued for %s", p.RemoteAddr(), remote.ID, ip.certifiedID())
+	}
+
+	ip.setIdentity(remote.Identity)
+
+	return nil
+}
+
+func isTLS(conn net.Conn) bool {
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+// writeHello writes the hello prefixed with its length, so the other side
+// never reads past it into whatever follows.
+func writeHello(w io.Writer, h hello) error {
+	buf := new(bytes.Buffer)
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(buf).Encode(h); err != nil {
+		return err
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	_, err := w.Write(b)
+	return err
+}
+
+func readHello(r io.Reader) (hello, error) {
+	var h hello
+
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return h, err
+	}
+
+	n := binary.BigEndian.Uint32(size)
+	if n > maxHelloSize {
+		return h, errors.New("hello is too large")
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return h, err
+	}
+
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&h)
+	return h, err
+}
@@ -0,0 +1,40 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshake(t *testing.T) {
+	a, b := net.Pipe()
+	pa, pb := NewTCPPeer(a, true), NewTCPPeer(b, false)
+
+	ida := Identity{ID: "a", ListenAddr: ":3000", Capabilities: []string{"metadata"}}
+	idb := Identity{ID: "b", ListenAddr: ":4000", Location: "/zone-b/rack-1/host-1"}
+
+	errch := make(chan error, 1)
+	go func() { errch <- Handshake(pb, idb) }()
+
+	assert.Nil(t, Handshake(pa, ida))
+	assert.Nil(t, <-errch)
+
+	assert.Equal(t, idb, pa.Identity())
+	assert.Equal(t, ida, pb.Identity())
+	assert.True(t, pb.Identity().Has("metadata"))
+	assert.False(t, pa.Identity().Has("metadata"))
+}
+
+func TestHandshakeRejectsIncompatibleVersion(t *testing.T) {
+	a, b := net.Pipe()
+	pa := NewTCPPeer(a, true)
+
+	go func() {
+		writeHello(b, hello{Version: ProtocolVersion + 1, Identity: Identity{ID: "b"}})
+		readHello(b)
+	}()
+
+	assert.NotNil(t, Handshake(pa, Identity{ID: "a"}))
+	assert.Empty(t, pa.Identity().ID)
+}
@@ -0,0 +1,407 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// streamWindow is the number of bytes the sender of a stream may have in
+// flight before the receiver grants it more room. It bounds the memory a
+// stream takes up on the receiving side, however slowly it is read.
+const streamWindow = 256 * 1024
+
+var (
+	// ErrStreamReset is returned by the operations on a stream the other side
+	// gave up on.
+	ErrStreamReset  = errors.New("stream reset by peer")
+	errStreamClosed = errors.New("stream closed")
+	errPeerClosed   = errors.New("connection to peer closed")
+)
+
+// Stream is a logical stream of bytes multiplexed with any number of other
+// streams and messages over the connection of a peer. A stream flows in one
+// direction only: the side that opened it writes, the side that accepted it
+// reads. The writer can never get more than streamWindow bytes ahead of the
+// reader, so a stream that is not read does not hold up anything else on the
+// connection.
+//
+// Neither Read nor Write may be called from multiple goroutines at once.
+type Stream struct {
+	id   uint64
+	peer *TCPPeer
+	// outbound is true for the streams we opened, which we write to.
+	outbound bool
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// Sending side.
+	opened bool
+	window int
+
+	// Receiving side.
+	buf bytes.Buffer
+	// ungranted is the number of bytes read since the last window update.
+	ungranted int
+	// closed is set once the reader closed the stream.
+	closed bool
+
+	// done is set once the remote sent its last frame on the stream, err
+	// once the stream cannot be used anymore.
+	done bool
+	err  error
+}
+
+func newStream(peer *TCPPeer, id uint64, outbound bool) *Stream {
+	s := &Stream{
+		id:       id,
+		peer:     peer,
+		outbound: outbound,
+		window:   streamWindow,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// ID returns the ID of the stream, which the side that opened it has to tell
+// the side that should accept it.
+func (s *Stream) ID() uint64 {
+	return s.id
+}
+
+// Write writes to a stream we opened. It blocks while the reader on the other
+// side is a whole window behind.
+func (s *Stream) Write(b []byte) (int, error) {
+	if !s.outbound {
+		return 0, fmt.Errorf("stream %d is not ours to write to", s.id)
+	}
+
+	nw := 0
+	for len(b) > 0 {
+		s.lock.Lock()
+		for s.window == 0 && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			err := s.err
+			s.lock.Unlock()
+			return nw, err
+		}
+
+		n := min(len(b), s.window, maxDataSize)
+		s.window -= n
+		flags := s.openFlag()
+		s.lock.Unlock()
+
+		f := Frame{
+			FrameHeader: FrameHeader{Type: IncomingStream, Flags: flags, ID: s.id},
+			Payload:     b[:n],
+		}
+		if err := s.peer.writeFrame(f); err != nil {
+			return nw, err
+		}
+
+		nw += n
+		b = b[n:]
+	}
+
+	return nw, nil
+}
+
+// openFlag returns the flag the next frame of the stream has to carry so the
+// remote learns about the stream. Must be called with the lock held.
+func (s *Stream) openFlag() byte {
+	if s.opened {
+		return 0
+	}
+	s.opened = true
+	return flagOpen
+}
+
+// Read reads from a stream the remote opened. It returns io.EOF once the
+// remote closed the stream and everything it wrote has been read.
+func (s *Stream) Read(b []byte) (int, error) {
+	if s.outbound {
+		return 0, fmt.Errorf("stream %d is not ours to read from", s.id)
+	}
+
+	s.lock.Lock()
+	for s.buf.Len() == 0 && !s.done && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		err := s.err
+		s.lock.Unlock()
+		return 0, err
+	}
+	if s.buf.Len() == 0 {
+		s.lock.Unlock()
+		return 0, io.EOF
+	}
+
+	n, _ := s.buf.Read(b)
+
+	// Grant the room back in batches, there is no point in sending a window
+	// update for every read.
+	s.ungranted += n
+	grant := 0
+	if s.ungranted >= streamWindow/2 && !s.done {
+		grant, s.ungranted = s.ungranted, 0
+	}
+	s.lock.Unlock()
+
+	if grant > 0 {
+		f := Frame{
+			FrameHeader: FrameHeader{Type: frameWindowUpdate, ID: s.id},
+			Payload:     binary.BigEndian.AppendUint32(nil, uint32(grant)),
+		}
+		if err := s.peer.writeFrame(f); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Close closes the stream. On a stream we opened it tells the reader that
+// everything has been written. On a stream we accepted it tells the writer to
+// stop if it has not finished yet.
+func (s *Stream) Close() error {
+	if s.outbound {
+		return s.finish(flagEnd)
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	done := s.done
+	if s.err == nil {
+		s.err = errStreamClosed
+	}
+	s.buf.Reset()
+	s.lock.Unlock()
+
+	if done {
+		s.peer.removeStream(s.id)
+		return nil
+	}
+
+	// The stream is removed once the writer confirmed it stopped, otherwise
+	// frames it still has in flight could open the stream again.
+	return s.peer.writeFrame(Frame{FrameHeader: FrameHeader{Type: frameReset, ID: s.id}})
+}
+
+// Reset aborts a stream we opened, the reader gets ErrStreamReset instead of
+// io.EOF.
+func (s *Stream) Reset() error {
+	if !s.outbound {
+		return s.Close()
+	}
+	return s.finish(0)
+}
+
+// finish sends the last frame of a stream we opened, which is an empty stream
+// frame with flagEnd or a reset.
+func (s *Stream) finish(flags byte) error {
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil
+	}
+	s.err = errStreamClosed
+	f := Frame{FrameHeader: FrameHeader{Type: frameReset, ID: s.id}}
+	if flags == flagEnd {
+		f.Type = IncomingStream
+		f.Flags = flagEnd | s.openFlag()
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	s.peer.removeStream(s.id)
+
+	return s.peer.writeFrame(f)
+}
+
+// receive is called by the read loop for every frame of a stream the remote
+// opened.
+func (s *Stream) receive(f Frame) (remove bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.cond.Broadcast()
+
+	if s.done {
+		return false, fmt.Errorf("frame on stream %d after its last frame", s.id)
+	}
+
+	if f.Type == frameReset {
+		s.done = true
+		if s.err == nil {
+			s.err = ErrStreamReset
+		}
+		return s.closed, nil
+	}
+
+	if s.buf.Len()+len(f.Payload) > streamWindow {
+		return false, fmt.Errorf("stream %d exceeded its window", s.id)
+	}
+	// A reader that closed the stream is not interested in what is left.
+	if !s.closed {
+		s.buf.Write(f.Payload)
+	}
+	if f.Flags&flagEnd != 0 {
+		s.done = true
+		return s.closed, nil
+	}
+
+	return false, nil
+}
+
+// grant is called by the read loop for window updates and resets on a stream
+// we opened.
+func (s *Stream) grant(f Frame) (reset bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer s.cond.Broadcast()
+
+	if s.err != nil {
+		return false
+	}
+
+	if f.Type == frameReset {
+		s.err = ErrStreamReset
+		return true
+	}
+
+	s.window += int(binary.BigEndian.Uint32(f.Payload))
+	return false
+}
+
+// fail is called once the connection is gone.
+func (s *Stream) fail() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Whatever arrived in full can still be read.
+	if s.err == nil && !s.done {
+		s.err = errPeerClosed
+	}
+	s.cond.Broadcast()
+}
+
+// OpenStream implements the Peer interface.
+func (p *TCPPeer) OpenStream() (*Stream, error) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	if p.streams == nil {
+		return nil, errPeerClosed
+	}
+
+	// The side that dialed uses odd IDs, the side that accepted even ones,
+	// so both can open streams without agreeing on IDs first.
+	p.nextStreamID += 2
+	id := p.nextStreamID
+	if p.outbound {
+		id--
+	}
+
+	s := newStream(p, id, true)
+	p.streams[id] = s
+
+	return s, nil
+}
+
+// AcceptStream implements the Peer interface.
+func (p *TCPPeer) AcceptStream(id uint64) (*Stream, error) {
+	if p.isLocal(id) {
+		return nil, fmt.Errorf("stream %d was not opened by %s", id, p.RemoteAddr())
+	}
+
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	if p.streams == nil {
+		return nil, errPeerClosed
+	}
+
+	s, ok := p.streams[id]
+	if !ok {
+		s = newStream(p, id, false)
+		p.streams[id] = s
+	}
+
+	return s, nil
+}
+
+// isLocal reports whether the stream ID is one of the IDs we open streams
+// with.
+func (p *TCPPeer) isLocal(id uint64) bool {
+	return (id%2 == 1) == p.outbound
+}
+
+func (p *TCPPeer) removeStream(id uint64) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	delete(p.streams, id)
+}
+
+// handleStreamFrame routes a frame of the read loop to its stream. Frames of
+// streams that are gone already are dropped, they were in flight while the
+// stream got closed.
+func (p *TCPPeer) handleStreamFrame(f Frame) error {
+	p.streamLock.Lock()
+	s, ok := p.streams[f.ID]
+	if !ok && f.Type == IncomingStream && f.Flags&flagOpen != 0 && !p.isLocal(f.ID) {
+		s = newStream(p, f.ID, false)
+		p.streams[f.ID] = s
+		ok = true
+	}
+	p.streamLock.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if s.outbound {
+		if f.Type == IncomingStream {
+			return fmt.Errorf("stream frame on stream %d we opened", f.ID)
+		}
+		if s.grant(f) {
+			// Confirm the reset, so the reader can let go of the stream.
+			p.removeStream(f.ID)
+			go p.writeFrame(Frame{FrameHeader: FrameHeader{Type: frameReset, ID: f.ID}})
+		}
+		return nil
+	}
+
+	if f.Type == frameWindowUpdate {
+		return fmt.Errorf("window update on stream %d we did not open", f.ID)
+	}
+
+	remove, err := s.receive(f)
+	if remove {
+		p.removeStream(f.ID)
+	}
+
+	return err
+}
+
+// closeStreams fails every stream of the peer once its connection is gone.
+func (p *TCPPeer) closeStreams() {
+	p.streamLock.Lock()
+	streams := p.streams
+	p.streams = nil
+	p.streamLock.Unlock()
+
+	for _, s := range streams {
+		s.fail()
+	}
+}
@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectTestPeers connects two transports and returns the peer each of them
+// got for the other, together with the transport of the second peer.
+func connectTestPeers(t *testing.T, addrA, addrB string) (Peer, Peer, *TCPTransport) {
+	start := func(addr string, id string) (*TCPTransport, chan Peer) {
+		peers := make(chan Peer, 1)
+		tr := NewTCPTransport(TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: IdentityHandshakeFunc(Identity{ID: id, ListenAddr: addr}),
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				peers <- p
+				return nil
+			},
+		})
+		require.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr, peers
+	}
+
+	_, aPeers := start(addrA, "node-a")
+	b, bPeers := start(addrB, "node-b")
+	require.Nil(t, b.Dial(addrA))
+
+	pa, pb := <-aPeers, <-bPeers
+	t.Cleanup(func() { pa.Close() })
+
+	return pa, pb, b
+}
+
+func TestStreamsAreMultiplexed(t *testing.T) {
+	pa, pb, trb := connectTestPeers(t, ":3201", ":3202")
+
+	// A stream nobody reads yet, with far more data than fits in its window.
+	stalled, err := pa.OpenStream()
+	require.Nil(t, err)
+	stalledData := make([]byte, 4*streamWindow)
+	rand.Read(stalledData)
+	go func() {
+		stalled.Write(stalledData)
+		stalled.Close()
+	}()
+
+	// Messages still get through.
+	require.Nil(t, pa.SendMessage(1, []byte("foo not bar")))
+	select {
+	case rpc := <-trb.Consume():
+		assert.Equal(t, "foo not bar", string(rpc.Payload))
+	case <-time.After(time.Second):
+		t.Fatal("message is stuck behind a stream")
+	}
+
+	// So do other streams, in both directions at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		from, to := pa, pb
+		if i%2 == 1 {
+			from, to = pb, pa
+		}
+
+		data := make([]byte, streamWindow+i*1000)
+		rand.Read(data)
+
+		w, err := from.OpenStream()
+		require.Nil(t, err)
+		r, err := to.AcceptStream(w.ID())
+		require.Nil(t, err)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := w.Write(data)
+			assert.Nil(t, err)
+			assert.Nil(t, w.Close())
+		}()
+		go func() {
+			defer wg.Done()
+			b, err := io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(data, b))
+			assert.Nil(t, r.Close())
+		}()
+	}
+	wg.Wait()
+
+	r, err := pb.AcceptStream(stalled.ID())
+	require.Nil(t, err)
+	b, err := io.ReadAll(r)
+	require.Nil(t, err)
+	assert.True(t, bytes.Equal(stalledData, b))
+	assert.Nil(t, r.Close())
+
+	// Every stream is gone once both sides are done with it.
+	for _, p := range []Peer{pa, pb} {
+		tp := p.(*TCPPeer)
+		tp.streamLock.Lock()
+		assert.Empty(t, tp.streams)
+		tp.streamLock.Unlock()
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	pa, pb, _ := connectTestPeers(t, ":3203", ":3204")
+
+	w, err := pa.OpenStream()
+	require.Nil(t, err)
+	r, err := pb.AcceptStream(w.ID())
+	require.Nil(t, err)
+
+	// The reader gives up, which makes the writer stop once its window is
+	// used up.
+	require.Nil(t, r.Close())
+	_, err = w.Write(make([]byte, 2*streamWindow))
+	assert.Equal(t, ErrStreamReset, err)
+
+	// The writer gives up, which the reader gets instead of io.EOF.
+	w, err = pa.OpenStream()
+	require.Nil(t, err)
+	r, err = pb.AcceptStream(w.ID())
+	require.Nil(t, err)
+
+	_, err = w.Write([]byte("foo"))
+	require.Nil(t, err)
+	require.Nil(t, w.Reset())
+	_, err = io.ReadAll(r)
+	assert.Equal(t, ErrStreamReset, err)
+	require.Nil(t, r.Close())
+}
@@ -1,6 +1,9 @@
 package p2p
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
@@ -16,32 +19,84 @@ type TCPPeer struct {
 	// if we dial and retrieve a conn => outbound == true
 	// if we accept and retrieve a conn => outbound == false
 	outbound bool
-
-	wg *sync.WaitGroup
+	// identity is what the remote told about itself during the handshake.
+	identity Identity
+	// certID is the node ID in the certificate the remote presented, if the
+	// connection runs over TLS.
+	certID string
+
+	// sendLock keeps frames sent from different goroutines from interleaving.
+	sendLock sync.Mutex
+
+	streamLock   sync.Mutex
+	streams      map[uint64]*Stream
+	nextStreamID uint64
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		streams:  make(map[uint64]*Stream),
 	}
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// Identity implements the Peer interface. It is empty until the peer went
+// through a handshake that identifies it.
+func (p *TCPPeer) Identity() Identity {
+	return p.identity
+}
+
+func (p *TCPPeer) setIdentity(id Identity) {
+	p.identity = id
+}
+
+// Outbound implements the Peer interface.
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
 }
 
-func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
+func (p *TCPPeer) certifiedID() string {
+	return p.certID
+}
+
+func (p *TCPPeer) conn() net.Conn {
+	return p.Conn
+}
+
+func (p *TCPPeer) writeFrame(f Frame) error {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	_, err := p.Conn.Write(f.appendTo(make([]byte, 0, FrameHeaderSize+len(f.Payload))))
 	return err
 }
 
+// SendMessage implements the Peer interface. The payload is sent as a single
+// message frame.
+func (p *TCPPeer) SendMessage(requestID uint64, payload []byte) error {
+	if len(payload) > MaxMessageSize {
+		return errFrameTooLarge
+	}
+
+	return p.writeFrame(Frame{
+		FrameHeader: FrameHeader{Type: IncomingMessage, ID: requestID},
+		Payload:     payload,
+	})
+}
+
 type TCPTransportOpts struct {
 	ListenAddr    string
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerDisconnect is called once the connection of a peer that OnPeer
+	// accepted is gone.
+	OnPeerDisconnect func(Peer)
+	// TLSConfig makes the transport run mutual TLS on every connection. The
+	// certificate of a peer must be issued for its node ID, which the peer
+	// has to claim in the handshake. See LoadTLSConfig.
+	TLSConfig *tls.Config
 }
 
 type TCPTransport struct {
@@ -80,6 +135,9 @@ func (t *TCPTransport) Dial(addr string) error {
 	if err != nil {
 		return err
 	}
+	if t.TLSConfig != nil {
+		conn = tls.Client(conn, clientTLSConfig(t.TLSConfig))
+	}
 
 	go t.handleConn(conn, true)
 
@@ -93,6 +151,9 @@ func (t *TCPTransport) ListenAndAccept() error {
 	if err != nil {
 		return err
 	}
+	if t.TLSConfig != nil {
+		t.listener = tls.NewListener(t.listener, serverTLSConfig(t.TLSConfig))
+	}
 
 	go t.startAcceptLoop()
 
@@ -117,14 +178,28 @@ func (t *TCPTransport) startAcceptLoop() {
 }
 
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
+	var (
+		err       error
+		connected bool
+	)
+
+	peer := NewTCPPeer(conn, outbound)
 
 	defer func() {
 		fmt.Printf("dropping peer connection: %s", err)
 		conn.Close()
+		peer.closeStreams()
+
+		if connected && t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer)
+		}
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if peer.certID, err = tlsHandshake(tlsConn); err != nil {
+			return
+		}
+	}
 
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
@@ -135,25 +210,51 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	connected = true
 
-	// Read loop
+	from := conn.RemoteAddr().String()
+	if id := peer.Identity().ID; len(id) > 0 {
+		from = id
+	}
+
+	// Read loop. Stream frames are handed to their streams right away, so no
+	// stream, however slowly it is read, holds up the rest of the connection.
 	for {
-		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
-		if err != nil {
+		var f Frame
+		if f, err = ReadFrame(conn); err != nil {
 			return
 		}
 
-		rpc.From = conn.RemoteAddr().String()
-
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
+		if f.Type != IncomingMessage {
+			if err = peer.handleStreamFrame(f); err != nil {
+				return
+			}
 			continue
 		}
 
+		rpc := RPC{From: from}
+		if err = t.Decoder.Decode(bytes.NewReader(f.Payload), &rpc); err != nil {
+			return
+		}
+
 		t.rpcch <- rpc
 	}
 }
+
+// tlsHandshake runs the TLS handshake of the connection and returns the node ID
+// in the certificate of the peer.
+func tlsHandshake(conn *tls.Conn) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return "", err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("peer presented no certificate")
+	}
+
+	return CertificateID(certs[0]), nil
+}
@@ -2,8 +2,10 @@ package p2p
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTCPTransport(t *testing.T) {
@@ -17,3 +19,45 @@ func TestTCPTransport(t *testing.T) {
 
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func TestTCPTransportOnPeerDisconnect(t *testing.T) {
+	disconnected := make(chan Peer, 1)
+	a := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:       ":3107",
+		HandshakeFunc:    IdentityHandshakeFunc(Identity{ID: "node-a", ListenAddr: ":3107"}),
+		Decoder:          DefaultDecoder{},
+		OnPeerDisconnect: func(p Peer) { disconnected <- p },
+	})
+	require.Nil(t, a.ListenAndAccept())
+	defer a.Close()
+
+	// A connection that fails the handshake was never a peer.
+	bad := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: IdentityHandshakeFunc(Identity{ID: "node-a"}),
+		Decoder:       DefaultDecoder{},
+	})
+	require.Nil(t, bad.Dial(":3107"))
+
+	peers := make(chan Peer, 1)
+	b := NewTCPTransport(TCPTransportOpts{
+		HandshakeFunc: IdentityHandshakeFunc(Identity{ID: "node-b"}),
+		Decoder:       DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	require.Nil(t, b.Dial(":3107"))
+
+	p := <-peers
+	assert.True(t, p.Outbound())
+	require.Nil(t, p.Close())
+
+	select {
+	case p := <-disconnected:
+		assert.Equal(t, "node-b", p.Identity().ID)
+		assert.False(t, p.Outbound())
+	case <-time.After(time.Second):
+		t.Fatal("OnPeerDisconnect was not called")
+	}
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// LoadTLSConfig builds a config for mutual TLS out of the PEM encoded
+// certificate and key of the node and the certificate of the CA that signed
+// the certificates of all nodes.
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// CertificateID returns the node ID a certificate was issued for, which is
+// its common name.
+func CertificateID(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+// serverTLSConfig returns the config to accept peers with. Peers that dial us
+// have to present a certificate as well.
+func serverTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config
+}
+
+// clientTLSConfig returns the config to dial peers with. Nodes are addressed
+// by IP and port rather than by a host name their certificate could be issued
+// for, so unless a ServerName is configured the certificate chain of the peer
+// is verified without checking any host name. Who the peer is gets settled by
+// the node ID in its certificate instead.
+func clientTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if len(config.ServerName) > 0 {
+		return config
+	}
+
+	roots := config.RootCAs
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		return err
+	}
+
+	return config
+}
@@ -0,0 +1,158 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a self-signed certificate authority issuing node certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	writePEM(t, filepath.Join(ca.dir, "ca.pem"), "CERTIFICATE", der)
+
+	return ca
+}
+
+// config issues a certificate for the node ID and returns the mutual TLS
+// config of the node, loaded from disk.
+func (ca *testCA) config(t *testing.T, id string) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certFile := filepath.Join(ca.dir, id+".pem")
+	keyFile := filepath.Join(ca.dir, id+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+
+	config, err := LoadTLSConfig(certFile, keyFile, filepath.Join(ca.dir, "ca.pem"))
+	require.Nil(t, err)
+
+	return config
+}
+
+func writePEM(t *testing.T, path string, typ string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.Nil(t, os.WriteFile(path, b, 0o600))
+}
+
+// startTLSTransport starts a transport that claims to be node id and reports
+// the identity of every peer it accepts on the returned channel.
+func startTLSTransport(t *testing.T, addr string, id string, config *tls.Config) (*TCPTransport, chan Identity) {
+	peers := make(chan Identity, 1)
+
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    addr,
+		HandshakeFunc: IdentityHandshakeFunc(Identity{ID: id, ListenAddr: addr}),
+		Decoder:       DefaultDecoder{},
+		TLSConfig:     config,
+		OnPeer: func(p Peer) error {
+			peers <- p.Identity()
+			return nil
+		},
+	})
+	require.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+
+	return tr, peers
+}
+
+func waitPeer(peers chan Identity) (Identity, bool) {
+	select {
+	case id := <-peers:
+		return id, true
+	case <-time.After(time.Second):
+		return Identity{}, false
+	}
+}
+
+func TestTCPTransportMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+
+	_, aPeers := startTLSTransport(t, ":3101", "node-a", ca.config(t, "node-a"))
+	b, bPeers := startTLSTransport(t, ":3102", "node-b", ca.config(t, "node-b"))
+
+	require.Nil(t, b.Dial(":3101"))
+
+	id, ok := waitPeer(aPeers)
+	assert.True(t, ok)
+	assert.Equal(t, "node-b", id.ID)
+
+	id, ok = waitPeer(bPeers)
+	assert.True(t, ok)
+	assert.Equal(t, "node-a", id.ID)
+}
+
+func TestTCPTransportMutualTLSRejectsUnknownPeers(t *testing.T) {
+	ca := newTestCA(t)
+
+	_, aPeers := startTLSTransport(t, ":3103", "node-a", ca.config(t, "node-a"))
+
+	// A certificate issued by another CA.
+	rogue, _ := startTLSTransport(t, ":3104", "node-b", newTestCA(t).config(t, "node-b"))
+	require.Nil(t, rogue.Dial(":3103"))
+
+	// A valid certificate, but the node claims to be somebody else.
+	liar, _ := startTLSTransport(t, ":3105", "node-c", ca.config(t, "node-d"))
+	require.Nil(t, liar.Dial(":3103"))
+
+	// A valid certificate that does not name any node.
+	anonymous, _ := startTLSTransport(t, ":3108", "node-f", ca.config(t, ""))
+	require.Nil(t, anonymous.Dial(":3103"))
+
+	// No TLS at all.
+	plain, _ := startTLSTransport(t, ":3106", "node-e", nil)
+	require.Nil(t, plain.Dial(":3103"))
+
+	_, ok := waitPeer(aPeers)
+	assert.False(t, ok)
+}
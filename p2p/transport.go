@@ -5,8 +5,20 @@ import "net"
 // Peer is an interface that represents the remote node.
 type Peer interface {
 	net.Conn
-	Send([]byte) error
-	CloseStream()
+	// SendMessage sends the payload as a message frame belonging to the
+	// request with the given ID.
+	SendMessage(requestID uint64, payload []byte) error
+	// OpenStream opens a stream to write to. Its ID has to be passed on to
+	// the remote, which accepts the stream with it.
+	OpenStream() (*Stream, error)
+	// AcceptStream returns the stream with the given ID the remote opened.
+	AcceptStream(id uint64) (*Stream, error)
+	// Outbound reports whether we dialed the remote, rather than the remote
+	// dialing us.
+	Outbound() bool
+	// Identity returns what the remote node told about itself during the
+	// handshake.
+	Identity() Identity
 }
 
 // Transport is anything that handles the communication
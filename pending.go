@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// reply is a response message together with the peer it came from.
+type reply struct {
+	from string
+	msg  *Message
+}
+
+// pendingRequests correlates responses with the request that triggered them
+// by the RequestID carried in the Message envelope.
+type pendingRequests struct {
+	nextID atomic.Uint64
+
+	lock     sync.Mutex
+	requests map[uint64]chan reply
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		requests: make(map[uint64]chan reply),
+	}
+}
+
+// add registers a new request expecting up to n replies and returns its ID
+// together with the channel the replies will be delivered on.
+func (p *pendingRequests) add(n int) (uint64, chan reply) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	id := p.nextID.Add(1)
+	ch := make(chan reply, n)
+	p.requests[id] = ch
+
+	return id, ch
+}
+
+func (p *pendingRequests) remove(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.requests, id)
+}
+
+// deliver hands the response to whoever is waiting on its RequestID. It
+// returns false if nobody is waiting anymore, for example because the request
+// already timed out.
+func (p *pendingRequests) deliver(from string, msg *Message) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ch, ok := p.requests[msg.RequestID]
+	if !ok {
+		return false
+	}
+
+	select {
+	case ch <- reply{from: from, msg: msg}:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until the next reply arrives or the context is done.
+func (p *pendingRequests) wait(ctx context.Context, replies chan reply) (reply, error) {
+	select {
+	case r := <-replies:
+		return r, nil
+	case <-ctx.Done():
+		return reply{}, ctx.Err()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+const (
+	reconnectMinBackoff = 100 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// backoff returns how long to wait before the given reconnect attempt. The
+// wait doubles with every attempt up to reconnectMaxBackoff, and is jittered
+// over the whole range so nodes that lost the same peer do not all dial it at
+// once.
+func backoff(attempt int) time.Duration {
+	d := reconnectMaxBackoff
+	if attempt < 16 {
+		d = min(reconnectMinBackoff<<attempt, reconnectMaxBackoff)
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// keepConnected dials addr until a node listening on it is one of our peers,
+// or the server is stopped. Only one goroutine keeps each address connected.
+func (s *FileServer) keepConnected(addr string) {
+	s.peerLock.Lock()
+	if s.reconnecting[addr] {
+		s.peerLock.Unlock()
+		return
+	}
+	s.reconnecting[addr] = true
+	s.peerLock.Unlock()
+
+	defer func() {
+		s.peerLock.Lock()
+		delete(s.reconnecting, addr)
+		s.peerLock.Unlock()
+	}()
+
+	for attempt := 0; ; attempt++ {
+		if s.connectedTo(addr) {
+			return
+		}
+
+		log.Printf("[%s] attempting to connect with remote %s", s.Transport.Addr(), addr)
+		if err := s.Transport.Dial(addr); err != nil {
+			log.Printf("[%s] dial error: %s", s.Transport.Addr(), err)
+		}
+
+		// The handshake runs after Dial returned, so whether the attempt
+		// worked is only known on the next round.
+		select {
+		case <-time.After(backoff(attempt)):
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// connectedTo reports whether one of our peers listens on addr.
+func (s *FileServer) connectedTo(addr string) bool {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for _, p := range s.peers {
+		if p.Identity().ListenAddr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// OnPeerDisconnect forgets a peer whose connection is gone, and starts
+// reconnecting to it.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	id := p.Identity()
+
+	s.peerLock.Lock()
+	// The peer may have been replaced by a newer connection to the same node
+	// already.
+	current := s.peers[id.ID] == p
+	if current {
+		delete(s.peers, id.ID)
+		if s.metadataPeer == id.ID {
+			s.metadataPeer = ""
+		}
+	}
+	s.peerLock.Unlock()
+
+	if !current {
+		return
+	}
+
+	log.Printf("[%s] lost connection with remote %s (%s)", s.Transport.Addr(), id.ListenAddr, p.RemoteAddr())
+
+	select {
+	case <-s.quitch:
+		return
+	default:
+	}
+
+	if len(id.ListenAddr) > 0 {
+		go s.keepConnected(id.ListenAddr)
+	}
+}
+
+// preferConn decides which of two connections to the same node is kept, such
+// that both ends of the connections decide the same way: the one dialed by the
+// node with the lower ID wins. Of two connections dialed by the same node,
+// the newer one wins, the older one is likely dead already.
+func (s *FileServer) preferConn(existing, p p2p.Peer) bool {
+	dialer := func(p p2p.Peer) string {
+		if p.Outbound() {
+			return s.ID
+		}
+		return p.Identity().ID
+	}
+
+	a, b := dialer(existing), dialer(p)
+	if a == b {
+		return true
+	}
+	return b < a
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		d := backoff(attempt)
+		if d < reconnectMinBackoff/2 || d > reconnectMaxBackoff {
+			t.Fatalf("backoff of attempt %d is %s", attempt, d)
+		}
+	}
+
+	if d := backoff(0); d > reconnectMinBackoff {
+		t.Errorf("first backoff is %s", d)
+	}
+	if d := backoff(64); d < reconnectMaxBackoff/2 {
+		t.Errorf("backoff is not capped at %s: %s", reconnectMaxBackoff, d)
+	}
+}
+
+func TestFileServerReconnect(t *testing.T) {
+	servers := startTestServers(t, ":6150", ":6250")
+	s1, s2 := servers[0], servers[1]
+
+	old, ok := s2.peer(s1.ID)
+	if !ok {
+		t.Fatal("not connected")
+	}
+	old.Close()
+
+	// Both sides drop the peer and dial each other again, keeping the same
+	// one of the connections.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p1, ok1 := s1.peer(s2.ID)
+		p2, ok2 := s2.peer(s1.ID)
+		if ok1 && ok2 && p2 != old {
+			if p1.Outbound() == p2.Outbound() {
+				t.Errorf("servers kept different connections")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("servers did not reconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, ok := s2.metadataPeerConn(); !ok {
+		t.Errorf("metadata node was not restored")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Arithmetic over GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1, the field
+// Reed-Solomon codes are usually defined over. Addition is xor, products are
+// looked up in a table.
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be zero.
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+var errTooFewShards = errors.New("too few shards to reconstruct the data")
+
+// reedSolomon is a systematic Reed-Solomon code with data data shards and
+// parity parity shards. The data shards are the data itself, the parity
+// shards are computed from them with the rows of a Cauchy matrix. Every
+// square matrix made of rows of the identity and of a Cauchy matrix is
+// invertible, so the data can be recovered from any data of the shards.
+type reedSolomon struct {
+	data   int
+	parity int
+	// matrix maps the data shards to every shard, the identity on top of
+	// the Cauchy rows.
+	matrix [][]byte
+}
+
+func newReedSolomon(data int, parity int) (*reedSolomon, error) {
+	if data <= 0 || parity < 0 {
+		return nil, fmt.Errorf("invalid Reed-Solomon code with %d data and %d parity shards", data, parity)
+	}
+	// The rows and columns of the Cauchy matrix are told apart by distinct
+	// field elements.
+	if data+parity > 256 {
+		return nil, fmt.Errorf("Reed-Solomon codes have at most 256 shards, have %d", data+parity)
+	}
+
+	rs := &reedSolomon{data: data, parity: parity}
+	for i := 0; i < data+parity; i++ {
+		row := make([]byte, data)
+		for j := range row {
+			switch {
+			case i >= data:
+				row[j] = gfInv(byte(i) ^ byte(j))
+			case i == j:
+				row[j] = 1
+			}
+		}
+		rs.matrix = append(rs.matrix, row)
+	}
+
+	return rs, nil
+}
+
+// split cuts b into the data shards, padding the last one with zeros, and
+// leaves room for the parity shards encode computes.
+func (rs *reedSolomon) split(b []byte) [][]byte {
+	size := (len(b) + rs.data - 1) / rs.data
+	if size == 0 {
+		size = 1
+	}
+
+	padded := make([]byte, size*rs.data)
+	copy(padded, b)
+
+	shards := make([][]byte, rs.data+rs.parity)
+	for i := 0; i < rs.data; i++ {
+		shards[i] = padded[i*size : (i+1)*size : (i+1)*size]
+	}
+	return shards
+}
+
+// join appends the data shards to each other and cuts the result down to size
+// bytes, which undoes split.
+func (rs *reedSolomon) join(shards [][]byte, size int) []byte {
+	b := make([]byte, 0, size)
+	for _, shard := range shards[:rs.data] {
+		b = append(b, shard...)
+	}
+	return b[:size]
+}
+
+// encode computes the parity shards out of the data shards, which all have to
+// be of the same size.
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for i := rs.data; i < rs.data+rs.parity; i++ {
+		shards[i] = rs.combine(rs.matrix[i], shards[:rs.data], len(shards[0]))
+	}
+}
+
+// reconstruct fills in the missing shards, which are nil, out of the others.
+// At least data shards have to be present.
+func (rs *reedSolomon) reconstruct(shards [][]byte) error {
+	if len(shards) != rs.data+rs.parity {
+		return fmt.Errorf("want %d shards have %d", rs.data+rs.parity, len(shards))
+	}
+
+	present := []int{}
+	for i, shard := range shards {
+		if shard != nil {
+			present = append(present, i)
+		}
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+	if len(present) < rs.data {
+		return errTooFewShards
+	}
+	present = present[:rs.data]
+
+	size := len(shards[present[0]])
+	sub := make([][]byte, rs.data)
+	inputs := make([][]byte, rs.data)
+	for i, idx := range present {
+		if len(shards[idx]) != size {
+			return fmt.Errorf("shard %d has %d bytes, want %d", idx, len(shards[idx]), size)
+		}
+		sub[i] = rs.matrix[idx]
+		inputs[i] = shards[idx]
+	}
+
+	decode, err := invertMatrix(sub)
+	if err != nil {
+		return err
+	}
+
+	// The present shards are the data shards multiplied by sub, so the
+	// inverse gives the data shards back.
+	for j := 0; j < rs.data; j++ {
+		if shards[j] == nil {
+			shards[j] = rs.combine(decode[j], inputs, size)
+		}
+	}
+	for i := rs.data; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = rs.combine(rs.matrix[i], shards[:rs.data], size)
+		}
+	}
+
+	return nil
+}
+
+// combine returns the sum of the inputs, each multiplied by its coefficient.
+func (rs *reedSolomon) combine(coefficients []byte, inputs [][]byte, size int) []byte {
+	out := make([]byte, size)
+	for i, c := range coefficients {
+		if c == 0 {
+			continue
+		}
+		mul := &gfMul[c]
+		for k, b := range inputs[i] {
+			out[k] ^= mul[b]
+		}
+	}
+	return out
+}
+
+// invertMatrix inverts the square matrix by Gauss-Jordan elimination.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+
+	// Work on m with the identity appended to every row.
+	work := make([][]byte, n)
+	for i := range m {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		inv := gfInv(work[col][col])
+		for k := range work[col] {
+			work[col][k] = gfMul[inv][work[col][k]]
+		}
+
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			f := work[row][col]
+			for k := range work[row] {
+				work[row][k] ^= gfMul[f][work[col][k]]
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1001)
+	for i := range data {
+		data[i] = byte(rand.IntN(256))
+	}
+
+	shards := rs.split(data)
+	rs.encode(shards)
+	if len(shards) != 6 || len(shards[0]) != 251 || len(shards[5]) != 251 {
+		t.Fatalf("unexpected shards of %d bytes", len(shards[0]))
+	}
+	if !bytes.Equal(rs.join(shards, len(data)), data) {
+		t.Fatal("the data shards are not the data")
+	}
+
+	// Every pair of lost shards can be rebuilt.
+	for i := 0; i < 6; i++ {
+		for j := i + 1; j < 6; j++ {
+			lost := make([][]byte, len(shards))
+			copy(lost, shards)
+			lost[i], lost[j] = nil, nil
+
+			if err := rs.reconstruct(lost); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(lost[i], shards[i]) || !bytes.Equal(lost[j], shards[j]) {
+				t.Errorf("shards %d and %d were rebuilt wrong", i, j)
+			}
+		}
+	}
+
+	lost := make([][]byte, len(shards))
+	copy(lost, shards[:3])
+	if err := rs.reconstruct(lost); !errors.Is(err, errTooFewShards) {
+		t.Errorf("want %v have %v", errTooFewShards, err)
+	}
+
+	if _, err := newReedSolomon(200, 57); err == nil {
+		t.Errorf("expected more than 256 shards to be refused")
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+const (
+	defaultReplicationInterval       = 5 * time.Second
+	defaultMaxConcurrentReplications = 2
+)
+
+// MessageReplicate asks a node holding a replica of the Owner's Key to copy it
+// to the Target node, sending at most Bandwidth bytes per second unless it is
+// zero. With Move set the node drops its own replica once the Target
+// acknowledged the copy.
+type MessageReplicate struct {
+	Owner     string
+	Key       string
+	Target    string
+	Bandwidth int64
+	Move      bool
+}
+
+// MessageReplicateAck is sent back once the Target acknowledged the copy.
+type MessageReplicateAck struct {
+	Key string
+	Err string
+}
+
+// ReplicationStatus reports the progress of the re-replication of the keys
+// that lost replicas.
+type ReplicationStatus struct {
+	// UnderReplicated is the number of keys with fewer replicas than the
+	// replication factor, Lost the number of keys without any, Degraded the
+	// number of erasure coded blocks that lost a shard.
+	UnderReplicated int
+	Lost            int
+	Degraded        int
+	// InFlight is the number of keys being copied right now.
+	InFlight int
+	// Completed and Failed count the copies, and rebuilt shards, since the
+	// server started.
+	Completed int
+	Failed    int
+}
+
+// replicationManager restores the replicas lost with dead nodes. It runs on
+// the metadata node, which knows where every replica is: every key with fewer
+// replicas than the replication factor is copied from one of its surviving
+// holders to new targets, and every erasure coded block that lost shards has
+// them rebuilt, at most MaxConcurrentReplications keys at a time.
+type replicationManager struct {
+	// trigger makes the manager look for under-replicated keys right away.
+	trigger chan struct{}
+	// slots bounds the number of keys copied at once.
+	slots chan struct{}
+
+	lock      sync.Mutex
+	inFlight  map[string]bool
+	completed int
+	failed    int
+}
+
+func newReplicationManager(maxConcurrent int) *replicationManager {
+	return &replicationManager{
+		trigger:  make(chan struct{}, 1),
+		slots:    make(chan struct{}, maxConcurrent),
+		inFlight: make(map[string]bool),
+	}
+}
+
+// start marks the key as being copied, and reports false if it already is.
+func (m *replicationManager) start(k string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.inFlight[k] {
+		return false
+	}
+	m.inFlight[k] = true
+	return true
+}
+
+func (m *replicationManager) finish(k string, copied int, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.inFlight, k)
+	m.completed += copied
+	if err != nil {
+		m.failed++
+	}
+}
+
+// ReplicationStatus returns the progress of the re-replication. Only the
+// metadata node re-replicates, every other node reports zero.
+func (s *FileServer) ReplicationStatus() ReplicationStatus {
+	m := s.replication
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	st := ReplicationStatus{
+		InFlight:  len(m.inFlight),
+		Completed: m.completed,
+		Failed:    m.failed,
+	}
+	if s.MetadataNode {
+		st.UnderReplicated = len(s.metadata.UnderReplicated(s.ReplicationFactor))
+		st.Lost = len(s.metadata.Lost())
+		st.Degraded = len(s.metadata.Degraded())
+	}
+
+	return st
+}
+
+// replicationLoop forgets the replicas of the nodes that die and schedules
+// the under-replicated keys every ReplicationInterval.
+func (s *FileServer) replicationLoop() {
+	s.OnPeerDead(func(id string) {
+		if n := s.metadata.DropHolder(id); n > 0 {
+			log.Printf("[%s] %d keys lost a replica on %s", s.Transport.Addr(), n, id)
+		}
+
+		select {
+		case s.replication.trigger <- struct{}{}:
+		default:
+		}
+	})
+
+	ticker := time.NewTicker(s.ReplicationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.replication.trigger:
+		case <-s.quitch:
+			return
+		}
+
+		s.scheduleReplication()
+	}
+}
+
+// scheduleReplication starts copying every under-replicated key, repairing
+// every degraded stripe and moving the replicas the ring placed elsewhere,
+// unless the key is being worked on already, waiting for a free slot before
+// every key.
+func (s *FileServer) scheduleReplication() {
+	for _, r := range s.metadata.UnderReplicated(s.ReplicationFactor) {
+		if !s.scheduleRepair(metadataKey(r.Owner, r.Key), func() (int, error) {
+			copied, err := s.rereplicate(r)
+			if err != nil {
+				log.Printf("[%s] re-replicating (%s) failed: %s", s.Transport.Addr(), r.Key, err)
+			}
+			return copied, err
+		}) {
+			return
+		}
+	}
+
+	for _, st := range s.metadata.Degraded() {
+		if !s.scheduleRepair(metadataKey(st.Owner, st.Key), func() (int, error) {
+			rebuilt, err := s.repairStripe(st)
+			if err != nil {
+				log.Printf("[%s] rebuilding the shards of (%s) failed: %s", s.Transport.Addr(), st.Key, err)
+			}
+			return rebuilt, err
+		}) {
+			return
+		}
+	}
+
+	if s.ringPlacement {
+		s.scheduleRingMoves()
+	}
+}
+
+// scheduleRepair runs repair for the key in a free slot, unless the key is
+// being repaired already. It reports false if the server stopped.
+func (s *FileServer) scheduleRepair(k string, repair func() (int, error)) bool {
+	if !s.replication.start(k) {
+		return true
+	}
+
+	select {
+	case s.replication.slots <- struct{}{}:
+	case <-s.quitch:
+		s.replication.finish(k, 0, nil)
+		return false
+	}
+
+	go func() {
+		defer func() { <-s.replication.slots }()
+
+		copied, err := repair()
+		s.replication.finish(k, copied, err)
+	}()
+
+	return true
+}
+
+// rereplicate copies the key from one of its holders to as many new targets
+// as it takes to reach the replication factor, and returns the number of
+// copies made.
+func (s *FileServer) rereplicate(r Replicas) (int, error) {
+	source, ok := s.replicationSource(r.Holders)
+	if !ok {
+		return 0, fmt.Errorf("no holder of (%s) is connected", r.Key)
+	}
+
+	exclude := append([]string{r.Owner}, r.Holders...)
+	targets := s.placeReplicas(r.Key, exclude, s.ReplicationFactor-len(r.Holders))
+	if len(targets) == 0 {
+		return 0, fmt.Errorf("no node left to place (%s) on", r.Key)
+	}
+
+	copied := 0
+	for _, target := range targets {
+		msg := MessageReplicate{Owner: r.Owner, Key: r.Key, Target: target}
+
+		if err := s.transferReplicaFrom(source, msg, 2*s.RequestTimeout); err != nil {
+			return copied, err
+		}
+
+		// The target registers the replica itself, but the next round must not
+		// see the key under-replicated in the meantime.
+		s.metadata.Register(r.Owner, r.Key, target)
+		copied++
+	}
+
+	return copied, nil
+}
+
+// replicationSource picks a holder to copy from, preferring ourselves.
+func (s *FileServer) replicationSource(holders []string) (string, bool) {
+	for _, id := range holders {
+		if id == s.ID {
+			return id, true
+		}
+	}
+	for _, id := range holders {
+		if _, ok := s.peer(id); ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// placeReplicas picks n nodes, out of ourselves and our peers but none of
+// exclude or of the decommissioning ones, for replicas of the key according to
+// the placement policy. The excluded nodes that stay in service hold the key
+// already, the new replicas are spread away from them.
+func (s *FileServer) placeReplicas(key string, exclude []string, n int) []string {
+	skip := make(map[string]bool, len(exclude))
+	placed := []string{}
+	for _, id := range exclude {
+		if !skip[id] && !s.members.decommissioning(id) {
+			placed = append(placed, id)
+		}
+		skip[id] = true
+	}
+
+	s.peerLock.Lock()
+	candidates := []string{}
+	for id := range s.peers {
+		if !skip[id] && !s.members.decommissioning(id) {
+			candidates = append(candidates, id)
+		}
+	}
+	s.peerLock.Unlock()
+
+	if !skip[s.ID] && !s.members.decommissioning(s.ID) {
+		candidates = append(candidates, s.ID)
+	}
+
+	return s.place(key, candidates, placed, n)
+}
+
+// transferReplicaFrom has the source node transfer a replica, which may be
+// ourselves, and waits up to timeout for it to report back. The timeout has
+// to leave room for the source to wait RequestTimeout for the ack of the
+// target.
+func (s *FileServer) transferReplicaFrom(source string, msg MessageReplicate, timeout time.Duration) error {
+	if source == s.ID {
+		return s.transferReplica(msg)
+	}
+
+	peer, ok := s.peer(source)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", source)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	id, replies := s.pending.add(1)
+	defer s.pending.remove(id)
+
+	if err := s.send(peer, &Message{RequestID: id, Payload: msg}); err != nil {
+		return err
+	}
+
+	r, err := s.pending.wait(ctx, replies)
+	if err != nil {
+		return err
+	}
+
+	if ack := r.msg.Payload.(MessageReplicateAck); len(ack.Err) > 0 {
+		return errors.New(ack.Err)
+	}
+	return nil
+}
+
+// transferReplica streams our replica of the key, which is encrypted already,
+// to the target as is and waits for its verified ack. Only then the replica is
+// dropped if it is moved.
+func (s *FileServer) transferReplica(msg MessageReplicate) error {
+	peer, ok := s.peer(msg.Target)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", msg.Target)
+	}
+
+	id, replies := s.pending.add(1)
+	defer s.pending.remove(id)
+
+	checksum, err := s.sendReplica(peer, id, msg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	if s.waitAcks(ctx, replies, map[string]string{msg.Target: checksum}) != 1 {
+		return fmt.Errorf("%s did not acknowledge its copy of (%s)", msg.Target, msg.Key)
+	}
+
+	if !msg.Move {
+		return nil
+	}
+	if err := s.store.Delete(msg.Owner, msg.Key); err != nil {
+		return err
+	}
+	return s.registerReplica(msg.Owner, msg.Key, false)
+}
+
+// sendReplica streams our replica of the key to the peer, and returns the
+// checksum the peer has to echo in its ack. A shard goes as a shard of its
+// stripe. The replica is read to the end, so it is checked against its
+// checksum, and the stream is aborted if it is corrupt.
+func (s *FileServer) sendReplica(peer p2p.Peer, requestID uint64, msg MessageReplicate) (string, error) {
+	// Replicas written before checksums have no sidecar, and are no shards.
+	meta, err := s.store.Meta(msg.Owner, msg.Key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	size, r, err := s.store.Read(msg.Owner, msg.Key)
+	if err != nil {
+		return "", err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	store := &Message{
+		RequestID: requestID,
+		Payload: MessageStoreFile{
+			ID:     msg.Owner,
+			Key:    msg.Key,
+			Size:   size,
+			Shard:  meta.Shard,
+			Stripe: meta.Stripe,
+		},
+	}
+
+	return s.streamObject(peer, store, func(w io.Writer) (int64, error) {
+		if msg.Bandwidth > 0 {
+			w = newThrottledWriter(w, msg.Bandwidth)
+		}
+		return io.Copy(w, r)
+	})
+}
+
+func (s *FileServer) handleMessageReplicate(from string, id uint64, msg MessageReplicate) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	ack := MessageReplicateAck{Key: msg.Key}
+	if err := s.transferReplica(msg); err != nil {
+		ack.Err = err.Error()
+	}
+
+	return s.send(peer, &Message{RequestID: id, Payload: ack})
+}
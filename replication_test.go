@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFileServerRereplicatesLostReplicas(t *testing.T) {
+	configure := func(s *FileServer) {
+		s.ReplicationFactor = 2
+		s.WriteQuorum = 2
+		s.HeartbeatInterval = 50 * time.Millisecond
+		s.detector = newFailureDetector(150*time.Millisecond, 300*time.Millisecond)
+		s.ReplicationInterval = 100 * time.Millisecond
+	}
+	servers := startTestCluster(t, configure, ":6180", ":6280", ":6380", ":6480")
+	meta, owner := servers[0], servers[3]
+
+	if err := owner.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	key := hashKey(blockKey("picture.png", 0))
+
+	// Kill a holder other than the metadata node, which one of the two
+	// holders has to be.
+	var victim *FileServer
+	for _, id := range meta.metadata.Locate(owner.ID, key) {
+		for _, s := range servers[1:3] {
+			if s.ID == id {
+				victim = s
+			}
+		}
+	}
+	if victim == nil {
+		t.Fatalf("no holder to kill among %v", meta.metadata.Locate(owner.ID, key))
+	}
+	victim.Stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := meta.ReplicationStatus()
+		if st.Completed > 0 && st.UnderReplicated == 0 && st.InFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replicas were not restored: %+v", st)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	holders := meta.metadata.Locate(owner.ID, key)
+	if len(holders) != 2 {
+		t.Fatalf("want 2 holders have %v", holders)
+	}
+	for _, id := range holders {
+		if id == victim.ID {
+			t.Errorf("dead node is still a holder")
+		}
+		for _, s := range servers {
+			if s.ID == id && !s.store.Has(owner.ID, key) {
+				t.Errorf("[%s] is a holder without a replica", s.Transport.Addr())
+			}
+		}
+	}
+
+	// The dead node comes back with its disk and reports the replica it still
+	// holds, which the metadata node forgot when it dropped the node.
+	restarted := makeServer(victim.Transport.Addr(), ":6180")
+	configure(restarted)
+	go restarted.Start()
+	t.Cleanup(restarted.Stop)
+	eventually(t, "the restarted node did not report its replica", func() bool {
+		return slices.Contains(meta.metadata.Locate(owner.ID, key), restarted.ID)
+	})
+
+	// The restored replicas serve the file.
+	if err := owner.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owner.Get("picture.png"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileServerKeepsCorruptedReplicaFromMoving(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.ReplicationFactor = 1
+		s.WriteQuorum = 1
+	}, ":6119", ":6219", ":6319")
+	owner := servers[2]
+
+	if err := owner.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	key := hashKey(blockKey("picture.png", 0))
+	source, target := servers[0], servers[1]
+	if !source.store.Has(owner.ID, key) {
+		source, target = target, source
+	}
+
+	// Flip the last bit, which is only found out once all of it was sent.
+	path := fmt.Sprintf("%s/%s/%s", source.store.Root, owner.ID, source.store.PathTransformFunc(key).FullPath())
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0x01
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := source.transferReplica(MessageReplicate{Owner: owner.ID, Key: key, Target: target.ID, Move: true}); err == nil {
+		t.Fatal("expected moving a corrupted replica to fail")
+	}
+	if !source.store.Has(owner.ID, key) {
+		t.Errorf("the source dropped its replica")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if target.store.Has(owner.ID, key) {
+		t.Errorf("the target kept the corrupted replica")
+	}
+}
+
+func TestFileServerMetadataNodeRelearnsReplicas(t *testing.T) {
+	configure := func(s *FileServer) {
+		s.ReplicationFactor = 2
+		s.WriteQuorum = 2
+		s.HeartbeatInterval = 50 * time.Millisecond
+		s.detector = newFailureDetector(150*time.Millisecond, 300*time.Millisecond)
+	}
+	servers := startTestCluster(t, configure, ":6113", ":6213", ":6313")
+	meta, owner := servers[0], servers[2]
+
+	if err := owner.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	key := hashKey(blockKey("picture.png", 0))
+	holders := meta.metadata.Locate(owner.ID, key)
+	if len(holders) != 2 {
+		t.Fatalf("want 2 holders have %v", holders)
+	}
+
+	// The metadata node comes back with its disk, but without what it knew,
+	// and learns about every replica from the block reports.
+	meta.Stop()
+	eventually(t, "the stopped metadata node was not dropped", func() bool {
+		_, ok := owner.peer(meta.ID)
+		return !ok
+	})
+	restarted := makeServer(":6113", ":6213", ":6313")
+	restarted.MetadataNode = true
+	configure(restarted)
+	// Nothing gets replicated again in the meantime.
+	restarted.ReplicationInterval = time.Hour
+	go restarted.Start()
+	t.Cleanup(restarted.Stop)
+
+	eventually(t, "the restarted metadata node did not learn the replicas", func() bool {
+		return len(restarted.metadata.Locate(owner.ID, key)) == 2
+	})
+	for _, id := range holders {
+		if id != meta.ID && !slices.Contains(restarted.metadata.Locate(owner.ID, key), id) {
+			t.Errorf("%s did not report its replica", id)
+		}
+	}
+	if restarted.metadata.isShard(owner.ID, key) {
+		t.Errorf("a replica was reported as a shard")
+	}
+}
+
+func TestFileServerMetadataNodeRelearnsStripes(t *testing.T) {
+	configure := func(s *FileServer) {
+		s.HeartbeatInterval = 50 * time.Millisecond
+		s.detector = newFailureDetector(150*time.Millisecond, 300*time.Millisecond)
+	}
+	servers := startTestCluster(t, configure, ":6118", ":6218", ":6318", ":6418", ":6518")
+	meta, owner := servers[0], servers[4]
+
+	ec := ErasureCoding{Data: 2, Parity: 1}
+	if err := owner.StoreErasureCoded("cold.log", bytes.NewReader([]byte("some log lines")), ec); err != nil {
+		t.Fatal(err)
+	}
+	block := blockKey("cold.log", 0)
+
+	// The metadata node comes back without the stripes it knew, and learns
+	// them from the shards in the block reports.
+	meta.Stop()
+	eventually(t, "the stopped metadata node was not dropped", func() bool {
+		_, ok := owner.peer(meta.ID)
+		return !ok
+	})
+	restarted := makeServer(":6118", ":6218", ":6318", ":6418", ":6518")
+	restarted.MetadataNode = true
+	configure(restarted)
+	// Nothing gets rebuilt until a node dies.
+	restarted.ReplicationInterval = time.Hour
+	go restarted.Start()
+	t.Cleanup(restarted.Stop)
+
+	shards := func() int {
+		n := 0
+		for i := 0; i < ec.Shards(); i++ {
+			n += len(restarted.metadata.Locate(owner.ID, hashKey(shardKey(block, i))))
+		}
+		return n
+	}
+	eventually(t, "the restarted metadata node did not learn the shards", func() bool {
+		return shards() == ec.Shards()
+	})
+	if degraded := restarted.metadata.Degraded(); len(degraded) != 0 {
+		t.Fatalf("want no degraded stripes have %v", degraded)
+	}
+
+	// Losing a shard has the stripe it knows of rebuilt.
+	var (
+		victim *FileServer
+		lost   string
+	)
+	for _, s := range servers[1:4] {
+		for i := 0; i < ec.Shards(); i++ {
+			if key := hashKey(shardKey(block, i)); s.store.Has(owner.ID, key) {
+				victim, lost = s, key
+			}
+		}
+	}
+	victim.Stop()
+	eventually(t, "the lost shard was not rebuilt", func() bool {
+		holders := restarted.metadata.Locate(owner.ID, lost)
+		return len(holders) == 1 && holders[0] != victim.ID && len(restarted.metadata.Degraded()) == 0
+	})
+}
+
+func TestFileServerMetadataNodeTakesReportsFromHoldersOnly(t *testing.T) {
+	s := makeServer(":6122")
+	s.MetadataNode = true
+	t.Cleanup(func() { s.store.Clear() })
+
+	owner, holder, liar := generateID(), generateID(), generateID()
+	register := MessageRegisterReplica{Owner: owner, Key: "picture.png", Holder: holder}
+
+	for _, report := range []any{
+		register,
+		MessageBlockReport{Replicas: []MessageRegisterReplica{register}},
+		MessageRegisterStripe{Stripe: Stripe{Owner: owner, Key: "block", Shards: []string{"shard0"}, Data: 1}, Holders: []string{liar}},
+	} {
+		if err := s.handleMessage(liar, &Message{Payload: report}); err == nil {
+			t.Errorf("expected %T on behalf of another node to be refused", report)
+		}
+	}
+	if all := s.metadata.All(); len(all) != 0 {
+		t.Fatalf("unexpected replicas %v", all)
+	}
+
+	if err := s.handleMessage(holder, &Message{Payload: register}); err != nil {
+		t.Fatal(err)
+	}
+	unregister := MessageUnregisterReplica{Owner: owner, Key: "picture.png", Holder: holder}
+	if err := s.handleMessage(liar, &Message{Payload: unregister}); err == nil {
+		t.Errorf("expected an unregister on behalf of another node to be refused")
+	}
+	if holders := s.metadata.Locate(owner, "picture.png"); len(holders) != 1 || holders[0] != holder {
+		t.Errorf("want %s as the holder have %v", holder, holders)
+	}
+}
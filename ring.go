@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+)
+
+const (
+	defaultReplicationFactor = 3
+	defaultVirtualNodes      = 64
+)
+
+// PlacementFunc picks the n peers, out of the given candidates, that should
+// hold a replica of the (hashed) key. Implementations must be deterministic so
+// that every caller that sees the same set of peers agrees on the targets.
+type PlacementFunc func(key string, peers []string, n int) []string
+
+// Ring is a consistent hash ring. Every node is hashed onto the ring at
+// VirtualNodes points, and a key belongs to the first nodes found walking the
+// ring clockwise from the hash of the key. When a node joins or leaves only
+// the keys next to its points change owners, roughly 1/N of them. Rings are
+// never modified, a new one is built whenever the nodes change.
+type Ring struct {
+	vnodes int
+	points []ringPoint
+	nodes  []string
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+// NewRing builds a ring of the nodes with vnodes points each.
+func NewRing(vnodes int, nodes ...string) *Ring {
+	r := &Ring{vnodes: vnodes}
+
+	for _, node := range nodes {
+		if slices.Contains(r.nodes, node) {
+			continue
+		}
+		r.nodes = append(r.nodes, node)
+		for i := 0; i < vnodes; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(fmt.Sprintf("%s#%d", node, i)), node: node})
+		}
+	}
+	sort.Strings(r.nodes)
+
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+func ringHash(s string) uint64 {
+	hash := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// Nodes returns the nodes on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	return slices.Clone(r.nodes)
+}
+
+// Lookup returns the first n distinct nodes clockwise from the key.
+func (r *Ring) Lookup(key string, n int) []string {
+	return r.Place(key, r.nodes, n)
+}
+
+// Place returns the first n distinct nodes out of the candidates clockwise
+// from the key. Candidates that are not on the ring are placed as if they
+// were. It satisfies PlacementFunc.
+func (r *Ring) Place(key string, candidates []string, n int) []string {
+	ring := r
+	for _, c := range candidates {
+		if !slices.Contains(r.nodes, c) {
+			ring = NewRing(r.vnodes, append(r.Nodes(), candidates...)...)
+			break
+		}
+	}
+
+	want := make(map[string]bool, len(candidates))
+	for _, c := range candidates {
+		want[c] = true
+	}
+	n = min(n, len(want))
+
+	placed := []string{}
+	if n <= 0 {
+		return placed
+	}
+
+	h := ringHash(key)
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= h })
+	for i := 0; i < len(ring.points) && len(placed) < n; i++ {
+		node := ring.points[(start+i)%len(ring.points)].node
+		if want[node] && !slices.Contains(placed, node) {
+			placed = append(placed, node)
+		}
+	}
+
+	return placed
+}
+
+// placeOnRing is the default PlacementFunc, it places keys on the ring of the
+// cluster members.
+func (s *FileServer) placeOnRing(key string, peers []string, n int) []string {
+	return s.currentRing().Place(key, peers, n)
+}
+
+// currentRing returns the ring of every member that is not dead, which is
+// built again whenever the members change. The metadata node then moves the
+// replicas the new ring places elsewhere.
+func (s *FileServer) currentRing() *Ring {
+	nodes := []string{}
+	for _, m := range s.Members() {
+		if m.State != PeerDead {
+			nodes = append(nodes, m.ID)
+		}
+	}
+
+	s.ringLock.Lock()
+	prev := s.ring
+	if prev != nil && slices.Equal(prev.nodes, nodes) {
+		s.ringLock.Unlock()
+		return prev
+	}
+	next := NewRing(s.VirtualNodes, nodes...)
+	s.ring = next
+	if s.placedRing == nil {
+		s.placedRing = next
+	}
+	s.ringLock.Unlock()
+
+	if prev != nil && s.MetadataNode && s.ringPlacement {
+		select {
+		case s.replication.trigger <- struct{}{}:
+		default:
+		}
+	}
+
+	return next
+}
+
+// ringTargets returns the nodes the ring places the replicas of the owner's
+// key on, as the owner does when it stores the key.
+func (s *FileServer) ringTargets(r *Ring, owner string, key string) []string {
+	candidates := []string{}
+	for _, id := range r.Nodes() {
+		if id != owner && !s.members.decommissioning(id) {
+			candidates = append(candidates, id)
+		}
+	}
+
+	return spread(r.Place(key, candidates, len(candidates)), []string{owner}, s.topology, s.ReplicationFactor)
+}
+
+// scheduleRingMoves starts moving the replicas that the current ring places
+// on other nodes than the ring they were placed on. A replica only moves off
+// a node that was a target of its key and no longer is, to a node that became
+// one, so only the keys next to the points of the nodes that joined or left
+// move, and the moves of the balancer are not undone. The replicas of nodes
+// that died are left to re-replication, and shards stay where they are.
+// Moves that fail are tried again the next round, the replicas count as
+// placed on the current ring once no move is left.
+func (s *FileServer) scheduleRingMoves() {
+	next := s.currentRing()
+
+	s.ringLock.Lock()
+	prev := s.placedRing
+	s.ringLock.Unlock()
+
+	if prev == next {
+		return
+	}
+
+	pending := 0
+	for _, r := range s.metadata.All() {
+		if len(r.Holders) == 0 || s.metadata.isShard(r.Owner, r.Key) {
+			continue
+		}
+
+		before, after := s.ringTargets(prev, r.Owner, r.Key), s.ringTargets(next, r.Owner, r.Key)
+		sources, targets := []string{}, []string{}
+		for _, id := range r.Holders {
+			if slices.Contains(before, id) && !slices.Contains(after, id) {
+				sources = append(sources, id)
+			}
+		}
+		for _, id := range after {
+			if !slices.Contains(before, id) && !slices.Contains(r.Holders, id) {
+				targets = append(targets, id)
+			}
+		}
+		if len(sources) == 0 || len(targets) == 0 {
+			continue
+		}
+
+		pending++
+		if !s.scheduleRepair(metadataKey(r.Owner, r.Key), func() (int, error) {
+			moved, err := s.moveReplicas(r, sources, targets)
+			if err != nil {
+				log.Printf("[%s] moving (%s) to its new ring owners failed: %s", s.Transport.Addr(), r.Key, err)
+			}
+			return moved, err
+		}) {
+			return
+		}
+	}
+
+	if pending == 0 {
+		s.ringLock.Lock()
+		s.placedRing = next
+		s.ringLock.Unlock()
+	}
+}
+
+// moveReplicas moves the replicas of the key from the sources to the targets,
+// one each, and returns the number of replicas moved.
+func (s *FileServer) moveReplicas(r Replicas, sources []string, targets []string) (int, error) {
+	moved := 0
+	for i := 0; i < len(sources) && i < len(targets); i++ {
+		msg := MessageReplicate{Owner: r.Owner, Key: r.Key, Target: targets[i], Move: true}
+
+		if err := s.transferReplicaFrom(sources[i], msg, 2*s.RequestTimeout); err != nil {
+			return moved, err
+		}
+
+		s.metadata.Register(r.Owner, r.Key, targets[i])
+		s.metadata.Unregister(r.Owner, r.Key, sources[i])
+		moved++
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testRingNodes(n int) []string {
+	nodes := []string{}
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, fmt.Sprintf("node_%d", i))
+	}
+	return nodes
+}
+
+func TestRingLookup(t *testing.T) {
+	r := NewRing(defaultVirtualNodes, testRingNodes(5)...)
+
+	owners := r.Lookup("momsbestpicture", 3)
+	if len(owners) != 3 {
+		t.Fatalf("want 3 owners have %v", owners)
+	}
+	for i, owner := range owners {
+		if slices.Contains(owners[i+1:], owner) {
+			t.Errorf("owner %s is listed twice in %v", owner, owners)
+		}
+	}
+	if again := NewRing(defaultVirtualNodes, testRingNodes(5)...).Lookup("momsbestpicture", 3); !slices.Equal(owners, again) {
+		t.Errorf("rings of the same nodes disagree: %v and %v", owners, again)
+	}
+
+	if owners := r.Lookup("momsbestpicture", 10); len(owners) != 5 {
+		t.Errorf("want every node have %v", owners)
+	}
+
+	// Place picks the first candidates, which need not be on the ring.
+	placed := r.Place("momsbestpicture", []string{owners[1], "node_x"}, 1)
+	if len(placed) != 1 || (placed[0] != owners[1] && placed[0] != "node_x") {
+		t.Errorf("unexpected placement %v", placed)
+	}
+}
+
+func TestRingSpreadsKeys(t *testing.T) {
+	nodes := testRingNodes(10)
+	r := NewRing(defaultVirtualNodes, nodes...)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[r.Lookup(fmt.Sprintf("key_%d", i), 1)[0]]++
+	}
+
+	for _, node := range nodes {
+		if counts[node] < 500 || counts[node] > 1500 {
+			t.Errorf("%s owns %d of 10000 keys", node, counts[node])
+		}
+	}
+}
+
+func TestRingMinimalMovement(t *testing.T) {
+	nodes := testRingNodes(10)
+	before := NewRing(defaultVirtualNodes, nodes...)
+	joined := NewRing(defaultVirtualNodes, append(nodes, "node_new")...)
+	left := NewRing(defaultVirtualNodes, nodes[1:]...)
+
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key_%d", i)
+
+		// Only keys that the new node takes over move, about 1 in 11.
+		owner, newOwner := before.Lookup(key, 1)[0], joined.Lookup(key, 1)[0]
+		if owner != newOwner {
+			moved++
+			if newOwner != "node_new" {
+				t.Errorf("(%s) moved to %s", key, newOwner)
+			}
+		}
+
+		// Only keys of the node that left move.
+		owners := before.Lookup(key, 2)
+		for _, owner := range owners {
+			if owner != nodes[0] && !slices.Contains(left.Lookup(key, 2), owner) {
+				t.Errorf("(%s) moved away from %s", key, owner)
+			}
+		}
+	}
+	if moved == 0 || moved > 2*10000/11 {
+		t.Errorf("%d of 10000 keys moved", moved)
+	}
+}
+
+func TestFileServerPlacesOnRing(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.ReplicationFactor = 2
+		s.WriteQuorum = 2
+	}, ":6115", ":6215", ":6315", ":6415")
+	meta, owner := servers[0], servers[3]
+
+	if err := owner.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replicas are where the ring of the owner says, which is what Get
+	// asks first.
+	key := hashKey(blockKey("picture.png", 0))
+	holders := meta.metadata.Locate(owner.ID, key)
+	peers := []string{}
+	for _, s := range servers[:3] {
+		peers = append(peers, s.ID)
+	}
+	owners := owner.currentRing().Place(key, peers, 2)
+	slices.Sort(owners)
+	if !slices.Equal(holders, owners) {
+		t.Errorf("want replicas on %v have %v", owners, holders)
+	}
+
+	for _, p := range owner.owners(blockKey("picture.png", 0)) {
+		if !slices.Contains(holders, p.Identity().ID) {
+			t.Errorf("Get would ask %s, which holds no replica", p.Identity().ID)
+		}
+	}
+}
+
+func TestFileServerMovesReplicasWhenNodesJoin(t *testing.T) {
+	configure := func(s *FileServer) {
+		s.ReplicationFactor = 1
+		s.WriteQuorum = 1
+		s.GossipInterval = 50 * time.Millisecond
+		s.ReplicationInterval = 100 * time.Millisecond
+	}
+	servers := startTestCluster(t, configure, ":6123", ":6223", ":6323")
+	meta, owner := servers[0], servers[2]
+
+	for i := 0; i < 20; i++ {
+		if err := owner.Store(fmt.Sprintf("picture_%d.png", i), bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	joined := makeServer(":6423", ":6123")
+	configure(joined)
+	go joined.Start()
+	t.Cleanup(func() {
+		joined.Stop()
+		joined.store.Clear()
+	})
+
+	// The keys the new node took over moved to it, every other key stayed.
+	eventually(t, "the replicas did not move to the new node", func() bool {
+		ring := meta.currentRing()
+		if !slices.Contains(ring.Nodes(), joined.ID) {
+			return false
+		}
+
+		taken := 0
+		for _, r := range meta.metadata.All() {
+			targets := meta.ringTargets(ring, r.Owner, r.Key)
+			if !slices.Equal(r.Holders, targets) {
+				return false
+			}
+			if slices.Contains(targets, joined.ID) {
+				taken++
+			}
+		}
+		return taken > 0
+	})
+
+	for _, r := range meta.metadata.All() {
+		for _, s := range append(servers, joined) {
+			if has := s.store.Has(r.Owner, r.Key); has != slices.Contains(r.Holders, s.ID) {
+				t.Errorf("%s holding (%s) is %v, the metadata node says %v", s.ID, r.Key, has, r.Holders)
+			}
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"sync"
 	"time"
 
@@ -14,22 +18,117 @@ import (
 )
 
 type FileServerOpts struct {
-	ID                string
-	EncKey            []byte
+	ID string
+	// EncKey encrypts the replicas of our files when there is no Keystore.
+	EncKey []byte
+	// Keystore holds the keys of the node across restarts. When set, its
+	// current key is used instead of EncKey.
+	Keystore *Keystore
+	// DataKeys holds the wrapped data keys every file of the node is
+	// encrypted with. Defaults to the datakeys file in the storage root.
+	DataKeys          *DataKeys
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+	// ReplicationFactor is the number of peers, chosen by PlacementFunc, that
+	// receive a copy of every stored file.
+	ReplicationFactor int
+	// WriteQuorum is the minimum number of replicas that must be written for
+	// Store to succeed. Defaults to a majority of ReplicationFactor.
+	WriteQuorum int
+	// PlacementFunc ranks the candidates for the replicas of a key, which
+	// are then spread across failure domains in that order. The picks are
+	// the replica targets, and the peers Get asks first. Defaults to the
+	// consistent hash ring of the cluster members, with VirtualNodes points
+	// per node.
+	PlacementFunc PlacementFunc
+	VirtualNodes  int
+	// Topology is the failure domain of the node, which is advertised to the
+	// other nodes so they spread replicas across zones, racks and hosts.
+	Topology Topology
+	// RequestTimeout bounds how long Get and Store wait for the replies of
+	// the peers they sent a request to.
+	RequestTimeout time.Duration
+	// MetadataNode makes this server track the replica locations of every
+	// key in the cluster and answer location lookups of the other nodes.
+	MetadataNode bool
+	// BlockSize is the size of the blocks files are split into. Every block
+	// is encrypted and replicated on its own.
+	BlockSize int64
+	// HeartbeatInterval is how often a heartbeat is sent to every peer.
+	HeartbeatInterval time.Duration
+	// SuspectTimeout is how long a peer may stay silent before it is
+	// suspected, DeadTimeout how long before it is declared dead. They
+	// default to 3 and 6 heartbeat intervals.
+	SuspectTimeout time.Duration
+	DeadTimeout    time.Duration
+	// GossipInterval is how often the member list is gossiped to a few
+	// random peers.
+	GossipInterval time.Duration
+	// ReplicationInterval is how often the metadata node looks for keys that
+	// lost replicas, besides whenever a node dies. MaxConcurrentReplications
+	// bounds the number of keys it restores at once.
+	ReplicationInterval       time.Duration
+	MaxConcurrentReplications int
+	// BalanceThreshold is how far, as a fraction of the mean, the usage of a
+	// node may be off the mean usage before the balancer moves replicas
+	// away from it. BalanceBandwidth bounds the bytes per second every move
+	// sends. The metadata node runs the balancer every BalanceInterval, if
+	// set.
+	BalanceThreshold float64
+	BalanceBandwidth int64
+	BalanceInterval  time.Duration
+	// TombstoneTTL is how long the tombstone of a deleted key is kept and
+	// replayed to peers that connect. A peer that stays away for longer may
+	// bring its copy of the key back.
+	TombstoneTTL time.Duration
 }
 
+const (
+	defaultRequestTimeout = 5 * time.Second
+	defaultBlockSize      = 64 << 20
+	defaultTombstoneTTL   = 7 * 24 * time.Hour
+)
+
+// capabilityMetadata is advertised in the handshake by the metadata node.
+const capabilityMetadata = "metadata"
+
 type FileServer struct {
 	FileServerOpts
 
 	peerLock sync.Mutex
-	peers    map[string]p2p.Peer
+	// peers maps the ID of a node, as learned in the handshake, to its peer.
+	peers        map[string]p2p.Peer
+	metadataPeer string
+	// reconnecting holds the addresses keepConnected is dialing.
+	reconnecting map[string]bool
+
+	detector  *failureDetector
+	hookLock  sync.Mutex
+	deadHooks []func(id string)
+
+	members *membership
+
+	decommissionLock   sync.Mutex
+	decommissionStatus DecommissionStatus
 
-	store  *Store
-	quitch chan struct{}
+	ringLock sync.Mutex
+	ring     *Ring
+	// ringPlacement is set when replicas are placed on the ring, which is
+	// when they have to move as the ring changes. placedRing is the ring the
+	// metadata node last saw every replica placed on.
+	ringPlacement bool
+	placedRing    *Ring
+
+	metadata    *Metadata
+	replication *replicationManager
+
+	pending *pendingRequests
+
+	store    *Store
+	quitch   chan struct{}
+	stopOnce sync.Once
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
@@ -37,144 +136,1171 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
 	}
+	store := NewStore(storeOpts)
 
 	if len(opts.ID) == 0 {
 		opts.ID = generateID()
 	}
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+	if opts.WriteQuorum <= 0 {
+		opts.WriteQuorum = opts.ReplicationFactor/2 + 1
+	}
+	if opts.VirtualNodes <= 0 {
+		opts.VirtualNodes = defaultVirtualNodes
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = defaultBlockSize
+	}
+	if opts.DataKeys == nil {
+		// Losing the data keys loses every file they encrypt, so they are
+		// never kept in memory only.
+		dataKeys, err := OpenDataKeys(store.Root + "/datakeys")
+		if err != nil {
+			log.Fatalf("opening the data keys in %s failed: %s", store.Root, err)
+		}
+		opts.DataKeys = dataKeys
+	}
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if opts.SuspectTimeout <= 0 {
+		opts.SuspectTimeout = defaultSuspectHeartbeats * opts.HeartbeatInterval
+	}
+	if opts.GossipInterval <= 0 {
+		opts.GossipInterval = defaultGossipInterval
+	}
+	if opts.ReplicationInterval <= 0 {
+		opts.ReplicationInterval = defaultReplicationInterval
+	}
+	if opts.MaxConcurrentReplications <= 0 {
+		opts.MaxConcurrentReplications = defaultMaxConcurrentReplications
+	}
+	if opts.BalanceThreshold <= 0 {
+		opts.BalanceThreshold = defaultBalanceThreshold
+	}
+	if opts.BalanceBandwidth <= 0 {
+		opts.BalanceBandwidth = defaultBalanceBandwidth
+	}
+	if opts.TombstoneTTL <= 0 {
+		opts.TombstoneTTL = defaultTombstoneTTL
+	}
+	if opts.DeadTimeout <= opts.SuspectTimeout {
+		opts.DeadTimeout = 2 * opts.SuspectTimeout
+	}
 
-	return &FileServer{
+	s := &FileServer{
 		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
+		store:          store,
 		quitch:         make(chan struct{}),
 		peers:          make(map[string]p2p.Peer),
+		reconnecting:   make(map[string]bool),
+		detector:       newFailureDetector(opts.SuspectTimeout, opts.DeadTimeout),
+		metadata:       NewMetadata(),
+		replication:    newReplicationManager(opts.MaxConcurrentReplications),
+		pending:        newPendingRequests(),
+	}
+	if s.PlacementFunc == nil {
+		s.PlacementFunc = s.placeOnRing
+		s.ringPlacement = true
+	}
+	s.members = newMembership(s.identity())
+
+	return s
+}
+
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return peer.SendMessage(msg.RequestID, buf.Bytes())
+}
+
+// replicaTargets returns the n peers that should hold a replica, or a shard,
+// of the given (hashed) key according to the placement policy.
+func (s *FileServer) replicaTargets(key string, n int) []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	ids := make([]string, 0, len(s.peers))
+	for id := range s.peers {
+		if !s.members.decommissioning(id) {
+			ids = append(ids, id)
+		}
+	}
+
+	targets := []p2p.Peer{}
+	for _, id := range s.place(key, ids, []string{s.ID}, n) {
+		targets = append(targets, s.peers[id])
+	}
+
+	return targets
+}
+
+type Message struct {
+	// RequestID correlates a response with the request it answers. Responses
+	// echo the RequestID of the request they were triggered by.
+	RequestID uint64
+	Payload   any
+}
+
+// MessageStoreFile asks a peer to store a replica of the key, which is sent
+// over the stream with the given ID.
+type MessageStoreFile struct {
+	ID     string
+	Key    string
+	Size   int64
+	Stream uint64
+	// Shard is set when the object is a shard of an erasure coded block,
+	// which is never replicated, Stripe to the stripe of the block.
+	Shard  bool
+	Stripe *Stripe
+}
+
+// MessageStoreFileAck is sent back to the originator of a MessageStoreFile
+// once the replica has written (or failed to write) the stream to disk.
+type MessageStoreFileAck struct {
+	Key      string
+	Size     int64
+	Checksum string
+	Err      string
+}
+
+type MessageGetFile struct {
+	ID  string
+	Key string
+}
+
+// MessageGetFileResponse answers a MessageGetFile. If Err is empty the
+// encrypted file is sent over the stream with the given ID. It is Size bytes
+// long and must hash to Checksum.
+type MessageGetFileResponse struct {
+	Key      string
+	Size     int64
+	Checksum string
+	Stream   uint64
+	Err      string
+}
+
+// MessageDeleteFile asks a replica to delete its copy of the key and to keep
+// a tombstone for it. Copies written after Deleted are left alone.
+type MessageDeleteFile struct {
+	ID      string
+	Key     string
+	Deleted time.Time
+}
+
+type MessageDeleteFileAck struct {
+	Key string
+	Err string
+}
+
+// MessageRegisterReplica tells the metadata node that Holder has written a
+// replica, or a shard of Stripe if Shard is set, of the Owner's Key.
+type MessageRegisterReplica struct {
+	Owner  string
+	Key    string
+	Holder string
+	Shard  bool
+	Stripe *Stripe
+}
+
+// MessageBlockReport lists every replica and shard the sender holds. It is
+// sent whenever the sender connects to the metadata node, which may have been
+// restarted or have dropped the sender as a holder in the meantime.
+type MessageBlockReport struct {
+	Replicas []MessageRegisterReplica
+}
+
+// MessageUnregisterReplica tells the metadata node that Holder dropped its
+// replica of the Owner's Key.
+type MessageUnregisterReplica struct {
+	Owner  string
+	Key    string
+	Holder string
+}
+
+type MessageLocateFile struct {
+	Owner string
+	Key   string
+}
+
+type MessageLocateFileResponse struct {
+	Holders []string
+}
+
+// Get returns the contents of the file. Blocks that are not on local disk are
+// fetched from the replicas, spreading the fetches over the peers holding them.
+func (s *FileServer) Get(key string) (io.Reader, error) {
+	if s.store.HasTombstone(s.ID, hashKey(key)) {
+		return nil, fmt.Errorf("[%s] file (%s) has been deleted", s.Transport.Addr(), key)
+	}
+
+	ctx := context.Background()
+
+	manifest, err := s.manifest(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Erasure != nil {
+		err = s.fetchStripes(ctx, manifest)
+	} else {
+		err = s.fetchBlocks(ctx, manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.newBlockReader(manifest), nil
+}
+
+// getObject makes sure there is a local copy of the object, fetching it from
+// one of its replicas if needed.
+func (s *FileServer) getObject(ctx context.Context, key string) error {
+	legacy := s.legacyObject(key)
+	if s.hasValid(key) {
+		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
+		return nil
+	}
+
+	fmt.Printf("[%s] dont have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+
+	// Go straight to the owners of the key, and only ask the metadata node
+	// where the replicas are if none of them has it.
+	owners := s.owners(key)
+	if err := s.getObjectFrom(ctx, key, owners, legacy); err == nil {
+		return nil
+	}
+
+	return s.getObjectFrom(ctx, key, s.holders(ctx, key, owners), legacy)
+}
+
+// legacyObject reports whether the replicas of our object may be encrypted
+// the way they were before authenticated encryption. Every file stored since
+// has a data key of its own, so only a file without one can be that old.
+func (s *FileServer) legacyObject(key string) bool {
+	return !s.DataKeys.HasFile(blockFile(key))
+}
+
+// hasValid reports whether there is an intact local copy of the object. A
+// corrupted copy is removed so it gets fetched again from a replica.
+func (s *FileServer) hasValid(key string) bool {
+	if !s.store.Has(s.ID, key) {
+		return false
+	}
+
+	err := s.store.Verify(s.ID, key)
+	if err == nil {
+		return true
+	}
+
+	log.Printf("[%s] dropping local copy of (%s): %s", s.Transport.Addr(), key, err)
+	s.store.Delete(s.ID, key)
+
+	return false
+}
+
+// getObjectFrom tries the given peers in order until one of them serves the
+// object. Only legacy objects may come as unauthenticated streams.
+func (s *FileServer) getObjectFrom(ctx context.Context, key string, peers []p2p.Peer, legacy bool) error {
+	for _, peer := range peers {
+		n, err := s.fetch(ctx, peer, key, legacy)
+		if err != nil {
+			log.Printf("[%s] fetching (%s) from %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+
+		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
+
+		return nil
+	}
+
+	return fmt.Errorf("[%s] could not fetch (%s) from any replica", s.Transport.Addr(), key)
+}
+
+// owners returns the peers the placement policy puts the replicas of the key
+// on, which is where they are unless they got moved since.
+func (s *FileServer) owners(key string) []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	ids := make([]string, 0, len(s.peers))
+	for id := range s.peers {
+		ids = append(ids, id)
+	}
+
+	peers := []p2p.Peer{}
+	for _, id := range s.place(hashKey(key), ids, []string{s.ID}, s.ReplicationFactor) {
+		peers = append(peers, s.peers[id])
+	}
+
+	return peers
+}
+
+// holders returns the peers holding a replica of the key according to the
+// metadata node, leaving out the ones that were tried already.
+func (s *FileServer) holders(ctx context.Context, key string, tried []p2p.Peer) []p2p.Peer {
+	ids, err := s.locate(ctx, s.ID, hashKey(key))
+	if err != nil {
+		log.Printf("[%s] locating (%s) failed: %s", s.Transport.Addr(), key, err)
+		return nil
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := []p2p.Peer{}
+	for _, id := range ids {
+		if peer, ok := s.peers[id]; ok && !slices.Contains(tried, peer) {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+// locate looks up the IDs of the nodes holding a replica of the owner's
+// (hashed) key.
+func (s *FileServer) locate(ctx context.Context, owner string, key string) ([]string, error) {
+	if s.MetadataNode {
+		return s.metadata.Locate(owner, key), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.RequestTimeout)
+	defer cancel()
+
+	peer, ok := s.metadataPeerConn()
+	if !ok {
+		return nil, errors.New("no metadata node known")
+	}
+
+	id, replies := s.pending.add(1)
+	defer s.pending.remove(id)
+
+	msg := Message{
+		RequestID: id,
+		Payload: MessageLocateFile{
+			Owner: owner,
+			Key:   key,
+		},
+	}
+
+	if err := s.send(peer, &msg); err != nil {
+		return nil, err
+	}
+
+	r, err := s.pending.wait(ctx, replies)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.msg.Payload.(MessageLocateFileResponse).Holders, nil
+}
+
+// peer returns the peer of the node with the given ID.
+func (s *FileServer) peer(id string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[id]
+	return peer, ok
+}
+
+func (s *FileServer) metadataPeerConn() (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[s.metadataPeer]
+	return peer, ok
+}
+
+// registerReplica reports a replica we hold to the metadata node. Passing
+// register false reports that we dropped it.
+func (s *FileServer) registerReplica(owner string, key string, register bool) error {
+	if s.MetadataNode {
+		if register {
+			s.metadata.Register(owner, key, s.ID)
+		} else {
+			s.metadata.Unregister(owner, key, s.ID)
+		}
+		return nil
+	}
+
+	peer, ok := s.metadataPeerConn()
+	if !ok {
+		return nil
+	}
+
+	msg := Message{
+		Payload: MessageRegisterReplica{
+			Owner:  owner,
+			Key:    key,
+			Holder: s.ID,
+		},
+	}
+	if !register {
+		msg.Payload = MessageUnregisterReplica{
+			Owner:  owner,
+			Key:    key,
+			Holder: s.ID,
+		}
+	}
+
+	return s.send(peer, &msg)
+}
+
+// fetch asks a single peer for the file and writes the decrypted stream it
+// answers with to disk. The stream has to be authenticated unless the object
+// is legacy.
+func (s *FileServer) fetch(ctx context.Context, peer p2p.Peer, key string, legacy bool) (int64, error) {
+	var n int64
+
+	err := s.fetchReplica(ctx, peer, s.ID, hashKey(key), func(r io.Reader) error {
+		keyID, body, err := peekKeyID(r)
+		if err != nil {
+			return err
+		}
+
+		encKey, err := s.decryptionKey(keyID)
+		if err != nil {
+			return err
+		}
+
+		if legacy {
+			n, err = s.store.WriteDecryptLegacy(encKey, s.ID, key, body)
+		} else {
+			n, err = s.store.WriteDecrypt(encKey, s.ID, key, body)
+		}
+		return err
+	})
+
+	if err == nil {
+		return n, nil
+	}
+
+	// The stream is only checked once it was written in full, so whatever
+	// made it to disk has to go.
+	s.store.Delete(s.ID, key)
+
+	var corrupt *CorruptionError
+	if errors.As(err, &corrupt) {
+		return n, &CorruptionError{ID: s.ID, Key: key, Want: corrupt.Want, Have: corrupt.Have}
+	}
+
+	return n, err
+}
+
+// fetchReplica asks a single peer for its replica of the owner's (hashed) key
+// and passes the stream it answers with to read. The bytes read have to match
+// the checksum of the replica.
+func (s *FileServer) fetchReplica(ctx context.Context, peer p2p.Peer, owner string, key string, read func(io.Reader) error) error {
+	ctx, cancel := context.WithTimeout(ctx, s.RequestTimeout)
+	defer cancel()
+
+	id, replies := s.pending.add(1)
+	defer s.pending.remove(id)
+
+	msg := Message{
+		RequestID: id,
+		Payload: MessageGetFile{
+			ID:  owner,
+			Key: key,
+		},
+	}
+
+	if err := s.send(peer, &msg); err != nil {
+		return err
+	}
+
+	r, err := s.pending.wait(ctx, replies)
+	if err != nil {
+		return err
+	}
+
+	resp := r.msg.Payload.(MessageGetFileResponse)
+	if len(resp.Err) > 0 {
+		return errors.New(resp.Err)
+	}
+
+	stream, err := peer.AcceptStream(resp.Stream)
+	if err != nil {
+		return err
+	}
+	// Closing the stream before it was read in full tells the peer to stop
+	// sending.
+	defer stream.Close()
+
+	h := s.store.ChecksumFunc()
+	if err := read(io.TeeReader(io.LimitReader(stream, resp.Size), h)); err != nil {
+		return err
+	}
+
+	if have := hex.EncodeToString(h.Sum(nil)); len(resp.Checksum) > 0 && have != resp.Checksum {
+		return &CorruptionError{ID: owner, Key: key, Want: resp.Checksum, Have: have}
+	}
+
+	return nil
+}
+
+// Store splits the file into blocks of BlockSize bytes and stores every block
+// as an object of its own, followed by the manifest listing the blocks. The
+// file is streamed to disk block by block, so memory usage does not grow with
+// the size of the file. All replicas of the file are encrypted with a fresh
+// data key of its own.
+func (s *FileServer) Store(key string, r io.Reader) error {
+	return s.storeFile(key, r, nil)
+}
+
+// StoreErasureCoded is Store with every block erasure coded as ec says rather
+// than replicated.
+func (s *FileServer) StoreErasureCoded(key string, r io.Reader, ec ErasureCoding) error {
+	if err := ec.validate(); err != nil {
+		return err
+	}
+	return s.storeFile(key, r, &ec)
+}
+
+func (s *FileServer) storeFile(key string, r io.Reader, ec *ErasureCoding) error {
+	manifest := BlockManifest{
+		Key:       key,
+		BlockSize: s.BlockSize,
+		Erasure:   ec,
+	}
+
+	storeBlock := s.storeObject
+	if ec != nil {
+		storeBlock = func(key string, r io.Reader, encKey []byte) (int64, error) {
+			return s.storeStripe(key, r, encKey, *ec)
+		}
+	}
+
+	dataKey, err := s.newDataKey(key)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	for i := 0; ; i++ {
+		// An empty file still gets a single (empty) block, but a file that is a
+		// multiple of the block size must not end with one.
+		if i > 0 {
+			if _, err := br.Peek(1); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+
+		info := BlockInfo{Key: blockKey(key, i)}
+		n, err := storeBlock(info.Key, io.LimitReader(br, s.BlockSize), dataKey)
+		if err != nil {
+			return err
+		}
+		info.Size = n
+
+		manifest.Blocks = append(manifest.Blocks, info)
+		manifest.Size += n
+
+		if n < s.BlockSize {
+			break
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(manifest); err != nil {
+		return err
+	}
+
+	if _, err := s.storeObject(key, buf, dataKey); err != nil {
+		return err
+	}
+
+	// When the file is overwritten, the data keys of what it was are of no
+	// use anymore.
+	_, err = s.DataKeys.Replace(key, encryptionKeyID(dataKey))
+	return err
+}
+
+// storeObject writes the object to local disk and then streams it from disk to
+// the peers chosen by the placement policy, encrypted with encKey. It returns
+// the size of the object.
+func (s *FileServer) storeObject(key string, r io.Reader, encKey []byte) (int64, error) {
+	size, err := s.store.Write(s.ID, key, r)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.store.ClearTombstone(s.ID, hashKey(key)); err != nil {
+		return 0, err
+	}
+
+	return size, s.replicateObject(key, size, encKey)
+}
+
+// replicateObject streams the local copy of the object to the peers chosen by
+// the placement policy, all at once, encrypted with encKey, and records the ID
+// of that key on the local copy.
+func (s *FileServer) replicateObject(key string, size int64, encKey []byte) error {
+	msg := Message{
+		Payload: MessageStoreFile{
+			ID:   s.ID,
+			Key:  hashKey(key),
+			Size: encryptedSize(size),
+		},
+	}
+
+	targets := s.replicaTargets(hashKey(key), s.ReplicationFactor)
+	if len(targets) < s.WriteQuorum {
+		return fmt.Errorf("[%s] not enough peers to store (%s): have %d, write quorum is %d", s.Transport.Addr(), key, len(targets), s.WriteQuorum)
+	}
+
+	id, replies := s.pending.add(len(targets))
+	defer s.pending.remove(id)
+	msg.RequestID = id
+
+	// A slow peer must not hold up the others.
+	var (
+		wg        sync.WaitGroup
+		lock      sync.Mutex
+		checksums = make(map[string]string)
+	)
+	for _, peer := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			checksum, err := s.replicate(peer, &msg, key, encKey)
+			if err != nil {
+				log.Printf("[%s] replicating (%s) to %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+				return
+			}
+
+			lock.Lock()
+			checksums[peer.Identity().ID] = checksum
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	acked := s.waitAcks(ctx, replies, checksums)
+	if acked < s.WriteQuorum {
+		return fmt.Errorf("[%s] stored (%s) on %d replicas, write quorum is %d", s.Transport.Addr(), key, acked, s.WriteQuorum)
+	}
+
+	return s.store.SetKeyID(s.ID, key, encryptionKeyID(encKey))
+}
+
+// replicate announces the object to the peer and then streams its encrypted
+// contents from local disk right after the announcement. It returns the
+// checksum of the bytes that went over the wire, which the replica has to echo
+// in its ack.
+func (s *FileServer) replicate(peer p2p.Peer, msg *Message, key string, encKey []byte) (string, error) {
+	_, r, err := s.store.Read(s.ID, key)
+	if err != nil {
+		return "", err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		defer rc.Close()
+	}
+
+	return s.streamObject(peer, msg, func(w io.Writer) (int64, error) {
+		n, err := copyEncrypt(encKey, r, w)
+		return int64(n), err
+	})
+}
+
+// streamObject sends the MessageStoreFile to the peer together with a new
+// stream, which gets whatever write writes. It returns the checksum of the
+// bytes that went over the wire. A peer that stops reading would keep the
+// write waiting forever, so the stream is aborted once nothing went through
+// for RequestTimeout.
+func (s *FileServer) streamObject(peer p2p.Peer, msg *Message, write func(io.Writer) (int64, error)) (string, error) {
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return "", err
+	}
+
+	payload := msg.Payload.(MessageStoreFile)
+	payload.Stream = stream.ID()
+	if err := s.send(peer, &Message{RequestID: msg.RequestID, Payload: payload}); err != nil {
+		stream.Reset()
+		return "", err
+	}
+
+	var (
+		lock    sync.Mutex
+		done    bool
+		stalled bool
+	)
+	timer := time.AfterFunc(s.RequestTimeout, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if !done {
+			stalled = true
+			stream.Reset()
+		}
+	})
+	w := &progressWriter{w: stream, progress: func() { timer.Reset(s.RequestTimeout) }}
+
+	h := s.store.ChecksumFunc()
+	n, err := write(io.MultiWriter(w, h))
+
+	timer.Stop()
+	lock.Lock()
+	done = true
+	if stalled {
+		err = fmt.Errorf("%s took nothing for %s", peer.RemoteAddr(), s.RequestTimeout)
+	}
+	lock.Unlock()
+
+	if err != nil {
+		stream.Reset()
+		return "", err
+	}
+	if err := stream.Close(); err != nil {
+		return "", err
+	}
+
+	fmt.Printf("[%s] received and written (%d) bytes to %s\n", s.Transport.Addr(), n, peer.RemoteAddr())
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// progressWriter calls progress after every write that went through.
+type progressWriter struct {
+	w        io.Writer
+	progress func()
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.progress()
+	}
+	return n, err
+}
+
+// waitAcks blocks until every replica in checksums acknowledged its write or
+// the context expired, and returns the number of successful writes.
+func (s *FileServer) waitAcks(ctx context.Context, replies chan reply, checksums map[string]string) int {
+	acked := 0
+	for pending := len(checksums); pending > 0; {
+		r, err := s.pending.wait(ctx, replies)
+		if err != nil {
+			log.Printf("[%s] gave up waiting for %d acks: %s", s.Transport.Addr(), pending, err)
+			return acked
+		}
+
+		want, ok := checksums[r.from]
+		if !ok {
+			continue
+		}
+		delete(checksums, r.from)
+		pending--
+
+		ack := r.msg.Payload.(MessageStoreFileAck)
+		if len(ack.Err) > 0 {
+			log.Printf("[%s] replica %s failed to write (%s): %s", s.Transport.Addr(), r.from, ack.Key, ack.Err)
+			continue
+		}
+		if ack.Checksum != want {
+			log.Printf("[%s] replica %s wrote (%s) with checksum %s, want %s", s.Transport.Addr(), r.from, ack.Key, ack.Checksum, want)
+			continue
+		}
+		acked++
+	}
+
+	return acked
+}
+
+// Delete removes the file and all of its blocks, locally as well as on the
+// replicas, and forgets its data keys.
+func (s *FileServer) Delete(key string) error {
+	ctx := context.Background()
+
+	manifest, err := s.manifest(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	deleted := time.Now()
+	for _, block := range manifest.Blocks {
+		// A legacy file is its own single block.
+		if block.Key == key {
+			continue
+		}
+		// The block goes first, which takes its stripe along, or the
+		// metadata node would rebuild the shards as they are deleted.
+		if err := s.deleteObject(block.Key, deleted); err != nil {
+			return err
+		}
+		if manifest.Erasure == nil {
+			continue
+		}
+		for i := 0; i < manifest.Erasure.Shards(); i++ {
+			if err := s.deleteObject(shardKey(block.Key, i), deleted); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.deleteObject(key, deleted); err != nil {
+		return err
+	}
+
+	// Nothing is left for the data keys of the file to decrypt.
+	_, err = s.DataKeys.Revoke(key)
+	return err
+}
+
+// deleteObject removes the local copy of the object and asks every peer to
+// delete its replica. Peers that miss the delete catch up through the
+// tombstones that are exchanged when they connect again.
+func (s *FileServer) deleteObject(key string, deleted time.Time) error {
+	if err := s.store.Delete(s.ID, key); err != nil {
+		return err
+	}
+
+	if err := s.store.Tombstone(s.ID, hashKey(key), deleted); err != nil {
+		return err
+	}
+	if s.MetadataNode {
+		s.metadata.Forget(s.ID, hashKey(key))
+	}
+
+	s.peerLock.Lock()
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	s.peerLock.Unlock()
+
+	id, replies := s.pending.add(len(peers))
+	defer s.pending.remove(id)
+
+	msg := Message{
+		RequestID: id,
+		Payload: MessageDeleteFile{
+			ID:      s.ID,
+			Key:     hashKey(key),
+			Deleted: deleted,
+		},
 	}
-}
 
-func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
-		return err
+	sent := 0
+	for _, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] sending delete of (%s) to %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		sent++
 	}
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
-			return err
+	ctx, cancel := context.WithTimeout(context.Background(), s.RequestTimeout)
+	defer cancel()
+
+	for ; sent > 0; sent-- {
+		r, err := s.pending.wait(ctx, replies)
+		if err != nil {
+			log.Printf("[%s] gave up waiting for %d delete acks: %s", s.Transport.Addr(), sent, err)
+			break
+		}
+
+		if ack := r.msg.Payload.(MessageDeleteFileAck); len(ack.Err) > 0 {
+			log.Printf("[%s] replica %s failed to delete (%s): %s", s.Transport.Addr(), r.from, key, ack.Err)
 		}
 	}
 
 	return nil
 }
 
-type Message struct {
-	Payload any
+// masterKey returns the ID of the key data keys are wrapped with and the key
+// itself.
+func (s *FileServer) masterKey() (string, []byte) {
+	if s.Keystore != nil {
+		return s.Keystore.Current()
+	}
+	return encryptionKeyID(s.EncKey), s.EncKey
 }
 
-type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
+// masterKeyByID returns the master key with the given ID.
+func (s *FileServer) masterKeyByID(id string) ([]byte, error) {
+	if s.Keystore != nil {
+		return s.Keystore.Key(id)
+	}
+	if id != encryptionKeyID(s.EncKey) {
+		return nil, fmt.Errorf("[%s] no key with id %s", s.Transport.Addr(), id)
+	}
+	return s.EncKey, nil
 }
 
-type MessageGetFile struct {
-	ID  string
-	Key string
+// newDataKey generates a data key for the file and stores it wrapped with the
+// current master key.
+func (s *FileServer) newDataKey(file string) ([]byte, error) {
+	dataKey := newEncryptionKey()
+
+	masterID, master := s.masterKey()
+	if _, err := s.DataKeys.Add(file, masterID, master, dataKey); err != nil {
+		return nil, err
+	}
+
+	return dataKey, nil
 }
 
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.store.Has(s.ID, key) {
-		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.store.Read(s.ID, key)
-		return r, err
+// decryptionKey returns the key with the given ID, which is the data key of a
+// file. Streams that were encrypted before data keys were introduced carry the
+// ID of a master key instead, or no ID at all, in which case the current
+// master key is tried.
+func (s *FileServer) decryptionKey(id string) ([]byte, error) {
+	if len(id) == 0 {
+		_, key := s.masterKey()
+		return key, nil
 	}
+	if s.DataKeys.Has(id) {
+		return s.DataKeys.Key(id, s.masterKeyByID)
+	}
+	return s.masterKeyByID(id)
+}
 
-	fmt.Printf("[%s] dont have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+// RotateKey switches the node to a new master key. The data keys are wrapped
+// with the new key right away, which leaves the replicas untouched. Replicas
+// that were encrypted with a master key directly, before data keys were
+// introduced, are re-encrypted with data keys in the background.
+func (s *FileServer) RotateKey() error {
+	if s.Keystore == nil {
+		return fmt.Errorf("[%s] key rotation needs a keystore", s.Transport.Addr())
+	}
 
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: hashKey(key),
-		},
+	id, err := s.Keystore.Rotate()
+	if err != nil {
+		return err
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+	_, master := s.Keystore.Current()
+	n, err := s.DataKeys.Rewrap(id, master, s.masterKeyByID)
+	if err != nil {
+		return err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	log.Printf("[%s] rotated to key %s and rewrapped %d data keys", s.Transport.Addr(), id, n)
 
-	for _, peer := range s.peers {
-		// First read the file size so we can limit the amount of bytes that we read
-		// from the connection, so it will not keep hanging.
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+	go s.reencrypt()
 
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
-		if err != nil {
-			return nil, err
+	return nil
+}
+
+// reencrypt replicates every object of ours whose replicas are not encrypted
+// with a data key again, each file with a data key of its own.
+func (s *FileServer) reencrypt() {
+	metas, err := s.store.Metas(s.ID)
+	if err != nil {
+		log.Printf("[%s] re-encryption failed: %s", s.Transport.Addr(), err)
+		return
+	}
+
+	var (
+		dataKeys = make(map[string][]byte)
+		done     = 0
+	)
+	for _, meta := range metas {
+		select {
+		case <-s.quitch:
+			return
+		default:
 		}
 
-		fmt.Printf("[%s] received (%d) bytes over the network from (%s)", s.Transport.Addr(), n, peer.RemoteAddr())
+		if s.DataKeys.Has(meta.KeyID) {
+			continue
+		}
+
+		file := blockFile(meta.Key)
+		dataKey, ok := dataKeys[file]
+		if !ok {
+			if dataKey, err = s.newDataKey(file); err != nil {
+				log.Printf("[%s] re-encrypting (%s) failed: %s", s.Transport.Addr(), meta.Key, err)
+				continue
+			}
+			dataKeys[file] = dataKey
+		}
 
-		peer.CloseStream()
+		if err := s.replicateObject(meta.Key, meta.Size, dataKey); err != nil {
+			log.Printf("[%s] re-encrypting (%s) failed: %s", s.Transport.Addr(), meta.Key, err)
+			continue
+		}
+		done++
 	}
 
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	log.Printf("[%s] re-encrypted %d objects with data keys", s.Transport.Addr(), done)
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
-
-	size, err := s.store.Write(s.ID, key, tee)
+// Revoke makes the file unreadable for good by forgetting its data key. The
+// replicas stay where they are, but nobody is able to decrypt them anymore.
+// The local copies are removed as well, since they are not encrypted.
+func (s *FileServer) Revoke(key string) error {
+	manifest, err := s.manifest(context.Background(), key)
 	if err != nil {
 		return err
 	}
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16,
-		},
+	for _, block := range manifest.Blocks {
+		if err := s.store.Delete(s.ID, block.Key); err != nil {
+			return err
+		}
 	}
-
-	if err := s.broadcast(&msg); err != nil {
+	if err := s.store.Delete(s.ID, key); err != nil {
 		return err
 	}
 
-	time.Sleep(time.Millisecond * 5)
-
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
-	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
+	n, err := s.DataKeys.Revoke(key)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+	log.Printf("[%s] revoked (%s) by dropping %d data keys", s.Transport.Addr(), key, n)
 
 	return nil
 }
 
 func (s *FileServer) Stop() {
-	close(s.quitch)
+	s.stopOnce.Do(func() { close(s.quitch) })
+}
+
+// Handshake identifies us to a new peer and learns its identity in turn. It
+// is meant to be used as the HandshakeFunc of the transport.
+func (s *FileServer) Handshake(p p2p.Peer) error {
+	return p2p.Handshake(p, s.identity())
+}
+
+// identity returns how the server presents itself to the other nodes.
+func (s *FileServer) identity() p2p.Identity {
+	local := p2p.Identity{
+		ID:         s.ID,
+		ListenAddr: s.Transport.Addr(),
+		Location:   s.Topology.Location(),
+	}
+	if s.MetadataNode {
+		local.Capabilities = append(local.Capabilities, capabilityMetadata)
+	}
+
+	return local
 }
 
 func (s *FileServer) OnPeer(p p2p.Peer) error {
+	id := p.Identity()
+	if len(id.ID) == 0 {
+		return fmt.Errorf("[%s] peer %s did not identify itself", s.Transport.Addr(), p.RemoteAddr())
+	}
+
 	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
+	existing, ok := s.peers[id.ID]
+	if ok && !s.preferConn(existing, p) {
+		s.peerLock.Unlock()
+		return fmt.Errorf("[%s] already connected with remote %s", s.Transport.Addr(), id.ListenAddr)
+	}
+	s.peers[id.ID] = p
+	if id.Has(capabilityMetadata) {
+		s.metadataPeer = id.ID
+	}
+	s.peerLock.Unlock()
+
+	// Both nodes dialed each other, or the old connection died without us
+	// noticing yet.
+	if ok {
+		existing.Close()
+	}
+	s.detector.heartbeat(id.ID, time.Now())
+	s.members.merge([]Member{{Identity: id}})
+
+	log.Printf("connected with remote %s (%s)", id.ListenAddr, p.RemoteAddr())
+
+	if err := s.syncTombstones(p); err != nil {
+		log.Printf("[%s] syncing tombstones with %s failed: %s", s.Transport.Addr(), p.RemoteAddr(), err)
+	}
+
+	if id.Has(capabilityMetadata) {
+		if err := s.sendBlockReport(p); err != nil {
+			log.Printf("[%s] sending the block report to %s failed: %s", s.Transport.Addr(), p.RemoteAddr(), err)
+		}
+	}
 
-	s.peers[p.RemoteAddr().String()] = p
+	return nil
+}
+
+// heldReplicas returns every replica and shard on local disk.
+func (s *FileServer) heldReplicas() ([]MessageRegisterReplica, error) {
+	ids, err := s.store.IDs()
+	if err != nil {
+		return nil, err
+	}
+
+	held := []MessageRegisterReplica{}
+	for _, id := range ids {
+		metas, err := s.store.Metas(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, meta := range metas {
+			if meta.Replica {
+				held = append(held, MessageRegisterReplica{
+					Owner:  id,
+					Key:    meta.Key,
+					Holder: s.ID,
+					Shard:  meta.Shard,
+					Stripe: meta.Stripe,
+				})
+			}
+		}
+	}
+
+	return held, nil
+}
+
+// sendBlockReport tells the metadata node about every replica and shard we
+// hold, which it only learns of as they are written otherwise.
+func (s *FileServer) sendBlockReport(p p2p.Peer) error {
+	held, err := s.heldReplicas()
+	if err != nil {
+		return err
+	}
+
+	return s.send(p, &Message{Payload: MessageBlockReport{Replicas: held}})
+}
+
+// syncTombstones replays every delete we know of to a (re)connected peer, so a
+// peer that was offline while a key got deleted drops its stale copy.
+// Tombstones older than TombstoneTTL are dropped instead.
+func (s *FileServer) syncTombstones(p p2p.Peer) error {
+	if _, err := s.store.ExpireTombstones(time.Now().Add(-s.TombstoneTTL)); err != nil {
+		return err
+	}
 
-	log.Printf("connected with remote %s", p.RemoteAddr())
+	tombstones, err := s.store.Tombstones()
+	if err != nil {
+		return err
+	}
+
+	for _, ts := range tombstones {
+		msg := Message{
+			Payload: MessageDeleteFile{
+				ID:      ts.ID,
+				Key:     ts.Key,
+				Deleted: ts.Deleted,
+			},
+		}
+		if err := s.send(p, &msg); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -191,10 +1317,17 @@ func (s *FileServer) loop() {
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				log.Println("decoding error: ", err)
+				continue
 			}
-			if err := s.handleMessage(rpc.From, &msg); err != nil {
-				log.Println("handle message error: ", err)
+			// Streams are multiplexed with the messages, so a handler busy
+			// with a stream, or with the disk, must not keep the other
+			// messages waiting. The others are handled in the order they
+			// arrived in.
+			if takesLong(msg.Payload) {
+				go s.dispatch(rpc.From, &msg)
+				continue
 			}
+			s.dispatch(rpc.From, &msg)
 
 		case <-s.quitch:
 			return
@@ -202,69 +1335,344 @@ func (s *FileServer) loop() {
 	}
 }
 
+// takesLong reports whether handling the message reads or writes a stream,
+// waits for another peer to do so, or walks the whole store.
+func takesLong(payload any) bool {
+	switch payload.(type) {
+	case MessageStoreFile, MessageGetFile, MessageReplicate, MessageGetUsage:
+		return true
+	}
+	return false
+}
+
+func (s *FileServer) dispatch(from string, msg *Message) {
+	if err := s.handleMessage(from, msg); err != nil {
+		log.Println("handle message error: ", err)
+	}
+}
+
 func (s *FileServer) handleMessage(from string, msg *Message) error {
+	s.detector.heartbeat(from, time.Now())
+
 	switch v := msg.Payload.(type) {
+	case MessageHeartbeat:
+		return nil
+	case MessageGossip:
+		return s.handleMessageGossip(from, v)
+	case MessageReplicate:
+		return s.handleMessageReplicate(from, msg.RequestID, v)
+	case MessageReplicateAck:
+		return s.handleResponse(from, msg)
+	case MessageGetUsage:
+		return s.handleMessageGetUsage(from, msg.RequestID)
+	case MessageUsage:
+		return s.handleResponse(from, msg)
+	case MessageRegisterReplica:
+		if err := checkReporter(from, v.Holder); err != nil {
+			return err
+		}
+		s.registerHeld(v)
+		return nil
+	case MessageBlockReport:
+		for _, r := range v.Replicas {
+			if err := checkReporter(from, r.Holder); err != nil {
+				return err
+			}
+		}
+		for _, r := range v.Replicas {
+			s.registerHeld(r)
+		}
+		return nil
+	case MessageUnregisterReplica:
+		if err := checkReporter(from, v.Holder); err != nil {
+			return err
+		}
+		s.metadata.Unregister(v.Owner, v.Key, v.Holder)
+		return nil
+	case MessageRegisterStripe:
+		if err := checkReporter(from, v.Owner); err != nil {
+			return err
+		}
+		s.metadata.RegisterStripe(v.Stripe, v.Holders)
+		return nil
+	case MessageLocateFile:
+		return s.handleMessageLocateFile(from, msg.RequestID, v)
+	case MessageLocateFileResponse:
+		return s.handleResponse(from, msg)
 	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
+		return s.handleMessageStoreFile(from, msg.RequestID, v)
+	case MessageStoreFileAck:
+		return s.handleResponse(from, msg)
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(from, msg.RequestID, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, msg.RequestID, v)
+	case MessageDeleteFileAck:
+		return s.handleResponse(from, msg)
+	case MessageGetFileResponse:
+		if s.pending.deliver(from, msg) {
+			return nil
+		}
+		return s.discardStream(from, v)
+	}
+
+	return nil
+}
+
+// checkReporter returns an error unless the node a peer reports about is the
+// peer itself. Nodes only report their own replicas, and stripes.
+func checkReporter(from string, node string) error {
+	if node != from {
+		return fmt.Errorf("peer %s reported on behalf of %s", from, node)
+	}
+	return nil
+}
+
+// registerHeld records a replica, or shard, a holder reported. The stripe of
+// a shard is recorded as well, unless its block got deleted.
+func (s *FileServer) registerHeld(msg MessageRegisterReplica) {
+	if !msg.Shard {
+		s.metadata.Register(msg.Owner, msg.Key, msg.Holder)
+		return
+	}
+
+	s.metadata.RegisterShard(msg.Owner, msg.Key, msg.Holder)
+	if msg.Stripe != nil && !s.store.HasTombstone(msg.Stripe.Owner, msg.Stripe.Key) {
+		s.metadata.AddStripe(*msg.Stripe)
+	}
+}
+
+func (s *FileServer) handleMessageLocateFile(from string, id uint64, msg MessageLocateFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	resp := MessageLocateFileResponse{
+		Holders: s.metadata.Locate(msg.Owner, msg.Key),
 	}
 
+	return s.send(peer, &Message{RequestID: id, Payload: resp})
+}
+
+func (s *FileServer) handleResponse(from string, msg *Message) error {
+	if !s.pending.deliver(from, msg) {
+		return fmt.Errorf("[%s] unexpected response (%d) from %s", s.Transport.Addr(), msg.RequestID, from)
+	}
 	return nil
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
+// discardStream closes the stream of a response that arrived after its request
+// was given up on, which tells the peer to stop sending.
+func (s *FileServer) discardStream(from string, msg MessageGetFileResponse) error {
+	if len(msg.Err) > 0 {
+		return nil
+	}
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	stream, err := peer.AcceptStream(msg.Stream)
+	if err != nil {
+		return err
+	}
+
+	return stream.Close()
+}
+
+func (s *FileServer) handleMessageGetFile(from string, id uint64, msg MessageGetFile) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	resp := MessageGetFileResponse{Key: msg.Key}
+
 	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+		resp.Err = fmt.Sprintf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+		return s.send(peer, &Message{RequestID: id, Payload: resp})
 	}
 
 	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
 
 	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
 	if err != nil {
-		return err
+		resp.Err = err.Error()
+		return s.send(peer, &Message{RequestID: id, Payload: resp})
 	}
 
 	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("closing readCloser")
 		defer rc.Close()
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return err
 	}
+	defer stream.Close()
 
-	// First send the "incomingStream" byte to the peer and then we can send
-	// the file size as an int64.
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
-	if err != nil {
+	resp.Size = fileSize
+	resp.Checksum, _ = s.store.Checksum(msg.ID, msg.Key)
+	resp.Stream = stream.ID()
+	if err := s.send(peer, &Message{RequestID: id, Payload: resp}); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	if _, err := io.CopyN(stream, r, fileSize); err != nil {
+		stream.Reset()
 		return err
 	}
 
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), fileSize, from)
 
 	return nil
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
+func (s *FileServer) handleMessageStoreFile(from string, id uint64, msg MessageStoreFile) error {
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	stream, err := peer.AcceptStream(msg.Stream)
 	if err != nil {
 		return err
 	}
+	// Closing the stream before it was read in full tells the peer to stop
+	// sending.
+	defer stream.Close()
+
+	if s.members.decommissioning(s.ID) {
+		ack := MessageStoreFileAck{
+			Key: msg.Key,
+			Err: fmt.Sprintf("[%s] is being decommissioned", s.Transport.Addr()),
+		}
+		return s.send(peer, &Message{RequestID: id, Payload: ack})
+	}
+
+	h := s.store.ChecksumFunc()
+	n, err := s.store.Write(msg.ID, msg.Key, io.TeeReader(&exactReader{r: stream, n: msg.Size}, h))
+	if err == nil {
+		err = s.store.SetReplica(msg.ID, msg.Key, msg.Stripe)
+	}
+	if err == nil {
+		if err = s.store.ClearTombstone(msg.ID, msg.Key); err == nil {
+			if msg.Shard {
+				err = s.registerShard(msg.ID, msg.Key, msg.Stripe)
+			} else {
+				err = s.registerReplica(msg.ID, msg.Key, true)
+			}
+		}
+	}
 
 	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
 
-	peer.CloseStream()
+	ack := MessageStoreFileAck{
+		Key:      msg.Key,
+		Size:     n,
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+	}
+	if err != nil {
+		ack.Err = err.Error()
+	}
+
+	return s.send(peer, &Message{RequestID: id, Payload: ack})
+}
+
+// exactReader reads n bytes from r and fails if r ends before that, or does
+// not end right after. A sender that finds out its copy is corrupt only once
+// it sent the last byte aborts the stream, which must not pass for complete.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
 
-	return nil
+func (e *exactReader) Read(b []byte) (int, error) {
+	if e.n <= 0 {
+		n, err := e.r.Read(make([]byte, 1))
+		if n > 0 {
+			return 0, errors.New("stream is longer than announced")
+		}
+		return 0, err
+	}
+	if int64(len(b)) > e.n {
+		b = b[:e.n]
+	}
+
+	n, err := e.r.Read(b)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		return n, io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (s *FileServer) handleMessageDeleteFile(from string, id uint64, msg MessageDeleteFile) error {
+	err := s.deleteReplica(msg)
+
+	// Deletes replayed from tombstones are not waiting for an answer.
+	if id == 0 {
+		return err
+	}
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+
+	ack := MessageDeleteFileAck{Key: msg.Key}
+	if err != nil {
+		ack.Err = err.Error()
+	}
+
+	return s.send(peer, &Message{RequestID: id, Payload: ack})
+}
+
+func (s *FileServer) deleteReplica(msg MessageDeleteFile) error {
+	if s.store.HasTombstone(msg.ID, msg.Key) {
+		return nil
+	}
+	// The key was written again after it got deleted. Peers that missed the
+	// write keep replaying the old delete, which must not take the new copy
+	// down. That includes the owner, whose copy is not kept under the hashed
+	// key.
+	if written, ok := s.store.LastWrite(msg.ID, msg.Key); ok && written.After(msg.Deleted) {
+		return nil
+	}
+	// A peer that did not expire the tombstone yet is replaying it.
+	if time.Since(msg.Deleted) > s.TombstoneTTL {
+		return nil
+	}
+
+	if s.store.Has(msg.ID, msg.Key) {
+		modTime, err := s.store.ModTime(msg.ID, msg.Key)
+		if err != nil {
+			return err
+		}
+		// The key was written again after it got deleted, keep the new copy.
+		if modTime.After(msg.Deleted) {
+			return nil
+		}
+
+		if err := s.store.Delete(msg.ID, msg.Key); err != nil {
+			return err
+		}
+		if err := s.registerReplica(msg.ID, msg.Key, false); err != nil {
+			return err
+		}
+	}
+	if s.MetadataNode {
+		s.metadata.Forget(msg.ID, msg.Key)
+	}
+
+	return s.store.Tombstone(msg.ID, msg.Key, msg.Deleted)
 }
 
 func (s *FileServer) bootstrapNetwork() error {
@@ -273,12 +1681,7 @@ func (s *FileServer) bootstrapNetwork() error {
 			continue
 		}
 
-		go func(addr string) {
-			fmt.Printf("[%s] attemping to connect with remote %s\n", s.Transport.Addr(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error: ", err)
-			}
-		}(addr)
+		go s.keepConnected(addr)
 	}
 
 	return nil
@@ -287,18 +1690,58 @@ func (s *FileServer) bootstrapNetwork() error {
 func (s *FileServer) Start() error {
 	fmt.Printf("[%s] starting fileserver...\n", s.Transport.Addr())
 
+	// The options may have changed since the server was created.
+	s.members.update(s.identity())
+
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
 
+	// A metadata node starts out knowing nothing, not even about the replicas
+	// on its own disk.
+	if s.MetadataNode {
+		held, err := s.heldReplicas()
+		if err != nil {
+			return err
+		}
+		for _, r := range held {
+			s.registerHeld(r)
+		}
+	}
+
 	s.bootstrapNetwork()
 
+	go s.heartbeat()
+	go s.gossip()
+	if s.MetadataNode {
+		go s.replicationLoop()
+	}
+	if s.MetadataNode && s.BalanceInterval > 0 {
+		go s.balanceLoop()
+	}
+
 	s.loop()
 
 	return nil
 }
 
 func init() {
+	gob.Register(MessageHeartbeat{})
+	gob.Register(MessageGossip{})
+	gob.Register(MessageReplicate{})
+	gob.Register(MessageReplicateAck{})
+	gob.Register(MessageGetUsage{})
+	gob.Register(MessageUsage{})
+	gob.Register(MessageRegisterReplica{})
+	gob.Register(MessageUnregisterReplica{})
+	gob.Register(MessageBlockReport{})
+	gob.Register(MessageRegisterStripe{})
+	gob.Register(MessageLocateFile{})
+	gob.Register(MessageLocateFileResponse{})
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreFileAck{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageDeleteFileAck{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageGetFileResponse{})
 }
@@ -0,0 +1,731 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ansh2004P/hdfs/p2p"
+)
+
+func TestMain(m *testing.M) {
+	// The keystores of the test servers need a passphrase.
+	if len(os.Getenv("HDFS_KEYSTORE_PASSPHRASE")) == 0 {
+		os.Setenv("HDFS_KEYSTORE_PASSPHRASE", "test passphrase")
+	}
+
+	os.Exit(m.Run())
+}
+
+// startTestServers starts a server for every address, each one bootstrapping
+// off the servers started before it.
+func startTestServers(tb testing.TB, addrs ...string) []*FileServer {
+	return startTestCluster(tb, nil, addrs...)
+}
+
+// startTestCluster is startTestServers with every server passed to configure
+// before it is started.
+func startTestCluster(tb testing.TB, configure func(*FileServer), addrs ...string) []*FileServer {
+	servers := []*FileServer{}
+	for i, addr := range addrs {
+		s := makeServer(addr, addrs[:i]...)
+		if i == 0 {
+			s.MetadataNode = true
+		}
+		if configure != nil {
+			configure(s)
+		}
+		servers = append(servers, s)
+	}
+
+	for _, s := range servers {
+		go s.Start()
+		time.Sleep(100 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	tb.Cleanup(func() {
+		for _, s := range servers {
+			s.Stop()
+			s.store.Clear()
+		}
+	})
+
+	return servers
+}
+
+func TestFileServerStoreGet(t *testing.T) {
+	servers := startTestServers(t, ":6100", ":6200", ":6300")
+	s := servers[2]
+	s.BlockSize = 1024
+
+	data := bytes.Repeat([]byte("some jpg bytes"), 1000)
+	if err := s.Store("picture.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove every local copy so all blocks come from the network.
+	if err := s.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %d bytes have %d bytes", len(data), len(b))
+	}
+
+	if err := s.Delete("picture.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("picture.png"); err == nil {
+		t.Errorf("expected Get to fail after Delete")
+	}
+}
+
+func TestFileServerRefetchesCorruptedReplica(t *testing.T) {
+	servers := startTestServers(t, ":6110", ":6210", ":6310")
+	s := servers[2]
+
+	data := []byte("some jpg bytes")
+	if err := s.Store("picture.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the replica held by the first server and remove every
+	// local copy, so Get has to find out and fall back to the other replica.
+	replica := servers[0].store
+	path := fmt.Sprintf("%s/%s/%s", replica.Root, s.ID, replica.PathTransformFunc(hashKey(blockKey("picture.png", 0))).FullPath())
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0x01
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+}
+
+func TestFileServerGetLegacyObject(t *testing.T) {
+	servers := startTestServers(t, ":6114", ":6214", ":6314")
+	holder, owner := servers[0], servers[2]
+
+	// Before files were split into blocks and got data keys of their own, a
+	// replica was the whole file encrypted with AES-CTR under the master key.
+	data := []byte("some jpg bytes")
+	_, master := owner.masterKey()
+	replica := encryptLegacy(t, master, data)
+	if _, err := holder.store.Write(owner.ID, hashKey("picture.png"), bytes.NewReader(replica)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := owner.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+
+	// Files stored since are not downgraded.
+	if err := owner.Store("other.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for _, holder := range servers[:2] {
+		if _, err := holder.store.Write(owner.ID, hashKey("other.png"), bytes.NewReader(encryptLegacy(t, master, data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := owner.Get("other.png"); err == nil {
+		t.Errorf("expected an unauthenticated replica of a new file to be refused")
+	}
+}
+
+func TestFileServerGetBaselineObject(t *testing.T) {
+	servers := startTestServers(t, ":6116", ":6216", ":6316")
+	holder, owner := servers[0], servers[2]
+
+	// Objects written before checksums were introduced have no sidecar: the
+	// owner kept the file as it is, the replica is its AES-CTR encryption.
+	data := []byte("some jpg bytes")
+	_, master := owner.masterKey()
+	if _, err := owner.store.Write(owner.ID, "picture.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := holder.store.Write(owner.ID, hashKey("picture.png"), bytes.NewReader(encryptLegacy(t, master, data))); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{owner.store.metaPath(owner.ID, "picture.png"), holder.store.metaPath(owner.ID, hashKey("picture.png"))} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func() {
+		t.Helper()
+		r, err := owner.Get("picture.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Errorf("want %s have %s", data, b)
+		}
+	}
+
+	get()
+	if !owner.store.Has(owner.ID, "picture.png") {
+		t.Errorf("expected the local copy without a checksum to be kept")
+	}
+
+	if err := owner.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	get()
+}
+
+func TestFileServerStoreGivesUpOnStalledPeer(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.RequestTimeout = 500 * time.Millisecond
+	}, ":6121", ":6221", ":6321")
+	owner := servers[2]
+
+	// A node that takes part in the cluster but never reads a stream.
+	stalled := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":6421",
+		HandshakeFunc: p2p.IdentityHandshakeFunc(p2p.Identity{ID: generateID(), ListenAddr: ":6421"}),
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	if err := stalled.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stalled.Close() })
+	if err := stalled.Dial(":6321"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the stalled node did not connect", func() bool {
+		return len(owner.replicaTargets("picture.png", 3)) == 3
+	})
+
+	// More than the stalled node ever takes before it reads.
+	data := bytes.Repeat([]byte("some jpg bytes"), 50*1024)
+	done := make(chan error, 1)
+	go func() { done <- owner.Store("picture.png", bytes.NewReader(data)) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Store is stuck on the stalled node")
+	}
+
+	for _, s := range servers[:2] {
+		if !s.store.Has(owner.ID, hashKey(blockKey("picture.png", 0))) {
+			t.Errorf("[%s] did not get its replica", s.Transport.Addr())
+		}
+	}
+}
+
+func TestFileServerRotateKey(t *testing.T) {
+	servers := startTestServers(t, ":6120", ":6220", ":6320")
+	s := servers[2]
+
+	data := []byte("some jpg bytes")
+	if err := s.Store("picture.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := s.store.Metas(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	masterID, _ := s.Keystore.Current()
+
+	// Rotating only rewraps the data keys, the replicas stay as they are.
+	for id, wk := range s.DataKeys.keys {
+		if wk.MasterID != masterID {
+			t.Errorf("data key %s is wrapped with %s, want %s", id, wk.MasterID, masterID)
+		}
+	}
+	after, err := s.store.Metas(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("want %d objects have %d", len(before), len(after))
+	}
+	for i := range after {
+		if after[i].KeyID != before[i].KeyID {
+			t.Errorf("object (%s) was re-encrypted", after[i].Key)
+		}
+	}
+
+	if err := s.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+}
+
+func TestFileServerRevoke(t *testing.T) {
+	servers := startTestServers(t, ":6130", ":6230", ":6330")
+	s := servers[2]
+
+	for _, key := range []string{"picture.png", "other.png"} {
+		if err := s.Store(key, bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Revoke("picture.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("picture.png"); err == nil {
+		t.Errorf("expected Get to fail after Revoke")
+	}
+
+	// Other files keep their own data keys.
+	if err := s.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("other.png"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileServerConcurrentStoreGet(t *testing.T) {
+	servers := startTestServers(t, ":6140", ":6240", ":6340")
+	s := servers[2]
+	s.BlockSize = 64 * 1024
+
+	files := make(map[string][]byte)
+	for i := 0; i < 8; i++ {
+		files[fmt.Sprintf("picture_%d.png", i)] = bytes.Repeat([]byte{byte(i)}, 200*1024+i)
+	}
+
+	// Every file goes over the same connections at the same time.
+	var wg sync.WaitGroup
+	for key, data := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Store(key, bytes.NewReader(data)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := s.store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, data := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.Get(key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(b, data) {
+				t.Errorf("(%s): want %d bytes have %d bytes", key, len(data), len(b))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFileServerWaitAcks(t *testing.T) {
+	s := makeServer(":6111")
+	t.Cleanup(func() { s.store.Clear() })
+
+	id, replies := s.pending.add(5)
+	defer s.pending.remove(id)
+
+	acks := map[string]MessageStoreFileAck{
+		"good":     {Key: "picture.png", Checksum: "aaaa"},
+		"mismatch": {Key: "picture.png", Checksum: "bbbb"},
+		"failed":   {Key: "picture.png", Err: "disk full"},
+		"stranger": {Key: "picture.png", Checksum: "aaaa"},
+	}
+	for from, ack := range acks {
+		s.pending.deliver(from, &Message{RequestID: id, Payload: ack})
+	}
+
+	// The silent replica never acks, so waitAcks gives up on the timeout.
+	checksums := map[string]string{
+		"good":     "aaaa",
+		"mismatch": "aaaa",
+		"failed":   "aaaa",
+		"silent":   "aaaa",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if acked := s.waitAcks(ctx, replies, checksums); acked != 1 {
+		t.Errorf("want 1 successful write have %d", acked)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected waitAcks to wait for the silent replica, returned after %s", elapsed)
+	}
+}
+
+func TestFileServerStoreWriteQuorum(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.ReplicationFactor = 2
+		s.WriteQuorum = 2
+		// The disk of the second server refuses every write.
+		if s.Transport.Addr() == ":6201" {
+			s.store.PathTransformFunc = func(key string) PathKey {
+				return PathKey{PathName: "\x00", Filename: key}
+			}
+		}
+	}, ":6101", ":6201", ":6301")
+	s := servers[2]
+
+	if err := s.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err == nil {
+		t.Fatal("expected Store to fail with one of two replicas failing to write")
+	}
+
+	s.WriteQuorum = 1
+	if err := s.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileServerCorrelatesResponses(t *testing.T) {
+	s := makeServer(":6112")
+	t.Cleanup(func() { s.store.Clear() })
+
+	first, firstReplies := s.pending.add(1)
+	second, secondReplies := s.pending.add(1)
+
+	resp := &Message{RequestID: second, Payload: MessageLocateFileResponse{Holders: []string{"b"}}}
+	if !s.pending.deliver("b", resp) {
+		t.Fatal("expected the response to be delivered")
+	}
+	if len(firstReplies) != 0 || len(secondReplies) != 1 {
+		t.Errorf("response went to the wrong request")
+	}
+
+	// Responses to requests that were given up on are dropped.
+	s.pending.remove(first)
+	if s.pending.deliver("b", &Message{RequestID: first, Payload: MessageLocateFileResponse{}}) {
+		t.Errorf("expected a response to a removed request to be dropped")
+	}
+	s.pending.remove(second)
+}
+
+func TestFileServerDiscardsLateResponses(t *testing.T) {
+	servers := startTestServers(t, ":6102", ":6202")
+	a, b := servers[0], servers[1]
+
+	peer, ok := a.peer(b.ID)
+	if !ok {
+		t.Fatal("expected the servers to be connected")
+	}
+	stream, err := peer.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody on b waits for this request, as if it timed out already.
+	msg := Message{
+		RequestID: 1 << 40,
+		Payload: MessageGetFileResponse{
+			Key:    "picture.png",
+			Size:   64 << 20,
+			Stream: stream.ID(),
+		},
+	}
+	if err := a.send(peer, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// b has to close the stream, or the copy blocks once the window is full.
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stream, io.LimitReader(zeroReader{}, 64<<20))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, p2p.ErrStreamReset) {
+			t.Errorf("want %v have %v", p2p.ErrStreamReset, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream of the late response was never discarded")
+	}
+}
+
+func TestFileServerHandlesMessagesInOrder(t *testing.T) {
+	servers := startTestServers(t, ":6108", ":6208")
+	meta, s := servers[0], servers[1]
+
+	peer, ok := s.metadataPeerConn()
+	if !ok {
+		t.Fatal("expected a connection to the metadata node")
+	}
+
+	// Every replica is dropped right after it was reported. Handled out of
+	// order, some of them stay registered.
+	n := 200
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("picture_%d.png", i)
+		for _, payload := range []any{
+			MessageRegisterReplica{Owner: s.ID, Key: key, Holder: s.ID},
+			MessageUnregisterReplica{Owner: s.ID, Key: key, Holder: s.ID},
+		} {
+			if err := s.send(peer, &Message{Payload: payload}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	last := MessageRegisterReplica{Owner: s.ID, Key: "last.png", Holder: s.ID}
+	if err := s.send(peer, &Message{Payload: last}); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the last replica was never registered", func() bool {
+		return len(meta.metadata.Locate(s.ID, "last.png")) > 0
+	})
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("picture_%d.png", i)
+		if holders := meta.metadata.Locate(s.ID, key); len(holders) > 0 {
+			t.Fatalf("(%s): want no holders have %v", key, holders)
+		}
+	}
+}
+
+// eventually fails the test unless cond turns true within a few seconds.
+func eventually(tb testing.TB, what string, cond func() bool) {
+	tb.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatal(what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFileServerDeleteReachesLaggingPeer(t *testing.T) {
+	configure := func(s *FileServer) {
+		s.ReplicationFactor = 2
+		s.WriteQuorum = 2
+		s.HeartbeatInterval = 50 * time.Millisecond
+		s.detector = newFailureDetector(150*time.Millisecond, 300*time.Millisecond)
+	}
+	servers := startTestCluster(t, configure, ":6103", ":6203", ":6303")
+	lagging, owner := servers[1], servers[2]
+
+	if err := owner.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	key := hashKey(blockKey("picture.png", 0))
+	if !lagging.store.Has(owner.ID, key) {
+		t.Fatal("expected the lagging peer to hold a replica")
+	}
+
+	// The peer goes away and misses the delete.
+	lagging.Stop()
+	eventually(t, "the stopped peer was not dropped", func() bool {
+		_, ok := owner.peer(lagging.ID)
+		return !ok
+	})
+	if err := owner.Delete("picture.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	// It comes back with the same disk and learns about the delete from the
+	// tombstones of the others.
+	restarted := makeServer(":6203", ":6103", ":6303")
+	configure(restarted)
+	go restarted.Start()
+	t.Cleanup(restarted.Stop)
+
+	eventually(t, "the lagging peer kept its replica", func() bool {
+		return !restarted.store.Has(owner.ID, key) && restarted.store.HasTombstone(owner.ID, key)
+	})
+}
+
+func TestFileServerRecreateAfterDelete(t *testing.T) {
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.ReplicationFactor = 2
+		s.WriteQuorum = 2
+	}, ":6104", ":6204", ":6304", ":6404")
+	owner := servers[3]
+
+	if err := owner.Store("picture.png", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.Delete("picture.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("some other jpg bytes")
+	if err := owner.Store("picture.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the replica targets heard about the new write, every other peer
+	// replays the old delete once it connects again.
+	old := make(map[string]p2p.Peer)
+	for _, s := range servers[:3] {
+		peer, ok := owner.peer(s.ID)
+		if !ok {
+			t.Fatalf("[%s] is not connected", s.Transport.Addr())
+		}
+		old[s.ID] = peer
+		peer.Close()
+	}
+	eventually(t, "the peers did not reconnect", func() bool {
+		for id, peer := range old {
+			if p, ok := owner.peer(id); !ok || p == peer {
+				return false
+			}
+		}
+		return true
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	if owner.store.HasTombstone(owner.ID, hashKey("picture.png")) {
+		t.Errorf("a replayed delete took the new file down")
+	}
+
+	r, err := owner.Get("picture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s", data, b)
+	}
+}
+
+// zeroReader is an endless source of zeros that holds no memory itself.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// BenchmarkFileServerStoreLargeFile stores a file far larger than a block and
+// reports the peak heap usage, which must stay flat regardless of file size.
+func BenchmarkFileServerStoreLargeFile(b *testing.B) {
+	const size = 256 << 20
+
+	servers := startTestServers(b, ":6400", ":6500")
+	s := servers[1]
+	s.ReplicationFactor = 1
+	s.WriteQuorum = 1
+	s.BlockSize = 8 << 20
+
+	var (
+		peak uint64
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapInuse)
+
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := s.Store("large.bin", io.LimitReader(zeroReader{}, size)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+}
@@ -1,17 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/gob"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
-const defaultRootFolderName = "ggnetwork"
+const (
+	defaultRootFolderName = "ggnetwork"
+	tombstoneFolderName   = ".tombstones"
+	writesFolderName      = ".writes"
+)
 
 func CASPathTransformFunc(key string) PathKey {
 	hash := sha1.Sum([]byte(key))
@@ -55,6 +66,9 @@ type StoreOpts struct {
 	// Root is the folder name of the root, containing all the folders/files of the system.
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// ChecksumFunc is the hash used to checksum every object written to the
+	// store. All nodes of a cluster must use the same one.
+	ChecksumFunc func() hash.Hash
 }
 
 var DefaultPathTransformFunc = func(key string) PathKey {
@@ -75,12 +89,173 @@ func NewStore(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRootFolderName
 	}
+	if opts.ChecksumFunc == nil {
+		opts.ChecksumFunc = sha256.New
+	}
 
 	return &Store{
 		StoreOpts: opts,
 	}
 }
 
+// ObjectMeta is kept in a sidecar file next to every object.
+type ObjectMeta struct {
+	Key      string
+	Size     int64
+	Checksum string
+	// KeyID is the ID of the key the replicas of the object were encrypted
+	// with, if the object is ours.
+	KeyID string
+	// Replica is set on the replicas, and shards, held for the metadata node
+	// to track, as opposed to the copies the owner keeps of its own objects.
+	Replica bool
+	Shard   bool
+	// Stripe is the stripe the object is a shard of.
+	Stripe *Stripe
+}
+
+func (s *Store) metaPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s.meta", s.Root, id, pathKey.FullPath())
+}
+
+// writeMeta replaces the sidecar of the object in one go, so it is never read
+// half written.
+func (s *Store) writeMeta(id string, meta ObjectMeta) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(meta); err != nil {
+		return err
+	}
+
+	path := s.metaPath(id, meta.Key)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Meta returns the sidecar metadata of the object.
+func (s *Store) Meta(id string, key string) (ObjectMeta, error) {
+	var meta ObjectMeta
+
+	f, err := os.Open(s.metaPath(id, key))
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&meta)
+	return meta, err
+}
+
+// SetKeyID records the ID of the key the replicas of the object were
+// encrypted with.
+func (s *Store) SetKeyID(id string, key string, keyID string) error {
+	meta, err := s.Meta(id, key)
+	if err != nil {
+		return err
+	}
+
+	meta.KeyID = keyID
+	return s.writeMeta(id, meta)
+}
+
+// SetReplica records that the object is a replica, or a shard of the stripe
+// if stripe is not nil, rather than a copy the owner keeps of its own object.
+func (s *Store) SetReplica(id string, key string, stripe *Stripe) error {
+	meta, err := s.Meta(id, key)
+	if err != nil {
+		return err
+	}
+
+	meta.Replica = true
+	meta.Shard = stripe != nil
+	meta.Stripe = stripe
+	return s.writeMeta(id, meta)
+}
+
+// Metas returns the metadata of every object stored under the id.
+func (s *Store) Metas(id string) ([]ObjectMeta, error) {
+	metas := []ObjectMeta{}
+
+	err := filepath.WalkDir(fmt.Sprintf("%s/%s", s.Root, id), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == tombstoneFolderName || d.Name() == writesFolderName) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".meta") {
+			return nil
+		}
+		// The sidecar is written before its object is moved in place, which
+		// may not have happened.
+		if _, err := os.Stat(strings.TrimSuffix(path, ".meta")); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var meta ObjectMeta
+		if err := gob.NewDecoder(f).Decode(&meta); err != nil {
+			return err
+		}
+		metas = append(metas, meta)
+
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return metas, nil
+	}
+
+	return metas, err
+}
+
+// IDs returns every id objects are stored under.
+func (s *Store) IDs() ([]string, error) {
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+
+	return ids, nil
+}
+
+// Checksum returns the checksum recorded when the object was written.
+func (s *Store) Checksum(id string, key string) (string, error) {
+	meta, err := s.Meta(id, key)
+	return meta.Checksum, err
+}
+
+// Verify reads the whole object and returns a *CorruptionError if it does not
+// match its checksum.
+func (s *Store) Verify(id string, key string) error {
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		return err
+	}
+	defer r.(io.Closer).Close()
+
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
 func (s *Store) Has(id string, key string) bool {
 	pathKey := s.PathTransformFunc(key)
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
@@ -93,50 +268,247 @@ func (s *Store) Clear() error {
 	return os.RemoveAll(s.Root)
 }
 
+// Delete removes the object and its sidecar, and then the folders they leave
+// empty. Other objects in the same folders are left alone.
 func (s *Store) Delete(id string, key string) error {
 	pathKey := s.PathTransformFunc(key)
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
+	path := s.objectPath(id, key)
 
-	if err := os.RemoveAll(firstPathNameWithRoot); err != nil {
-		return err
+	for _, p := range []string{path, s.metaPath(id, key)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	root := filepath.Clean(fmt.Sprintf("%s/%s", s.Root, id))
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// Fails once a folder holds anything else.
+		if os.Remove(dir) != nil {
+			break
+		}
 	}
+
 	log.Printf("deleted [%s] from disk (root=%s id=%s)", pathKey.Filename, s.Root, id)
 	return nil
 }
 
-func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
-	return s.writeStream(id, key, r)
+// Tombstone is left behind when a key is deleted so that a copy held by a
+// peer that missed the delete is not brought back to life later on.
+type Tombstone struct {
+	ID      string
+	Key     string
+	Deleted time.Time
 }
 
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+func (s *Store) tombstonePath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s/%s", s.Root, id, tombstoneFolderName, pathKey.Filename)
+}
+
+func (s *Store) writePath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s/%s", s.Root, id, writesFolderName, pathKey.Filename)
+}
+
+// mark leaves a file holding the key at path, with the given time as its
+// modification time.
+func (s *Store) mark(path string, key string, at time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, []byte(key), 0o644); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, at, at)
+}
+
+// Tombstone records that the key was deleted at the given time.
+func (s *Store) Tombstone(id string, key string, deleted time.Time) error {
+	return s.mark(s.tombstonePath(id, key), key, deleted)
+}
+
+func (s *Store) HasTombstone(id string, key string) bool {
+	_, err := os.Stat(s.tombstonePath(id, key))
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// ClearTombstone removes the tombstone of a key that is written again, and
+// records when that happened so that deletes from before the write, which
+// peers keep replaying, are ignored from now on.
+func (s *Store) ClearTombstone(id string, key string) error {
+	err := os.Remove(s.tombstonePath(id, key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return s.mark(s.writePath(id, key), key, time.Now())
+}
+
+// LastWrite returns the time the key was last written, as recorded by
+// ClearTombstone.
+func (s *Store) LastWrite(id string, key string) (time.Time, bool) {
+	fi, err := os.Stat(s.writePath(id, key))
 	if err != nil {
-		return 0, err
+		return time.Time{}, false
 	}
-	defer f.Close()
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+	return fi.ModTime(), true
 }
 
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+// ExpireTombstones drops the tombstones of the deletes, and the records of
+// the writes, that happened before the given time. It returns the number of
+// tombstones dropped.
+func (s *Store) ExpireTombstones(before time.Time) (int, error) {
+	n := 0
+	for _, folder := range []string{tombstoneFolderName, writesFolderName} {
+		paths, err := filepath.Glob(fmt.Sprintf("%s/*/%s/*", s.Root, folder))
+		if err != nil {
+			return n, err
+		}
+
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err != nil || !fi.ModTime().Before(before) {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return n, err
+			}
+			if folder == tombstoneFolderName {
+				n++
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// Tombstones returns every tombstone in the store, for all ids.
+func (s *Store) Tombstones() ([]Tombstone, error) {
+	dirs, err := filepath.Glob(fmt.Sprintf("%s/*/%s", s.Root, tombstoneFolderName))
+	if err != nil {
 		return nil, err
 	}
 
+	tombstones := []Tombstone{}
+	for _, dir := range dirs {
+		id := filepath.Base(filepath.Dir(dir))
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			key, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			fi, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+
+			tombstones = append(tombstones, Tombstone{
+				ID:      id,
+				Key:     string(key),
+				Deleted: fi.ModTime(),
+			})
+		}
+	}
+
+	return tombstones, nil
+}
+
+// ModTime returns the time the key was last written.
+func (s *Store) ModTime(id string, key string) (time.Time, error) {
+	pathKey := s.PathTransformFunc(key)
 	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
 
-	return os.Create(fullPathWithRoot)
+	fi, err := os.Stat(fullPathWithRoot)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
+	return s.writeStream(id, key, r)
+}
+
+// WriteDecrypt writes the decrypted stream as the object.
+func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+	return s.writeObject(id, key, func(w io.Writer) (int64, error) {
+		n, err := copyDecrypt(encKey, r, w)
+		return int64(n), err
+	})
+}
+
+// WriteDecryptLegacy is WriteDecrypt for objects that are known to predate
+// authenticated encryption, whose streams may be plain AES-CTR.
+func (s *Store) WriteDecryptLegacy(encKey []byte, id string, key string, r io.Reader) (int64, error) {
+	return s.writeObject(id, key, func(w io.Writer) (int64, error) {
+		n, err := copyDecryptLegacy(encKey, r, w)
+		return int64(n), err
+	})
 }
 
 func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
+	return s.writeObject(id, key, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+// writeObject has write write the object to a temporary file, which only
+// replaces the object, together with its sidecar, once all of it was written.
+// A write that fails halfway leaves nothing behind.
+func (s *Store) writeObject(id string, key string, write func(io.Writer) (int64, error)) (int64, error) {
 	f, err := s.openFileForWriting(id, key)
 	if err != nil {
 		return 0, err
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
-	return io.Copy(f, r)
+
+	h := s.ChecksumFunc()
+	n, err := write(io.MultiWriter(f, h))
+	if err != nil {
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+
+	// The sidecar goes first. Should the object not make it in place, the
+	// old one fails verification rather than the new one passing unchecked.
+	err = s.writeMeta(id, ObjectMeta{
+		Key:      key,
+		Size:     n,
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, os.Rename(f.Name(), s.objectPath(id, key))
+}
+
+func (s *Store) objectPath(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+}
+
+// openFileForWriting creates a temporary file next to where the object goes.
+func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
+	pathKey := s.PathTransformFunc(key)
+	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
+	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(pathNameWithRoot, pathKey.Filename+".*.tmp")
 }
 
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
@@ -144,18 +516,34 @@ func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
 }
 
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	file, err := os.Open(fullPathWithRoot)
+	file, err := os.Open(s.objectPath(id, key))
 	if err != nil {
 		return 0, nil, err
 	}
 
 	fi, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return 0, nil, err
 	}
 
-	return fi.Size(), file, nil
+	// Objects are only moved in place after their sidecar was written, so one
+	// without a sidecar was written before checksums were introduced and is
+	// served as it is.
+	meta, err := s.Meta(id, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return fi.Size(), file, nil
+	}
+	if err != nil {
+		file.Close()
+		return 0, nil, fmt.Errorf("reading the checksum of (%s) of %s: %w", key, id, err)
+	}
+
+	return fi.Size(), &verifyingReader{
+		r:    file,
+		h:    s.ChecksumFunc(),
+		id:   id,
+		key:  key,
+		want: meta.Checksum,
+	}, nil
 }
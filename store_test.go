@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestPathTransformFunc(t *testing.T) {
@@ -58,6 +62,198 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreDeleteKeepsNeighbours(t *testing.T) {
+	// Every object in the same folder.
+	s := NewStore(StoreOpts{
+		PathTransformFunc: func(key string) PathKey {
+			return PathKey{PathName: "shared", Filename: key}
+		},
+	})
+	id := generateID()
+	defer teardown(t, s)
+
+	for _, key := range []string{"foo", "bar"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete(id, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, "foo") {
+		t.Errorf("expected to NOT have key foo")
+	}
+	if err := s.Verify(id, "bar"); err != nil {
+		t.Errorf("expected key bar to be left alone: %s", err)
+	}
+
+	// The last object takes the folder along.
+	if err := s.Delete(id, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/%s/shared", s.Root, id)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the empty folder to be removed, have %v", err)
+	}
+}
+
+func TestStoreDetectsCorruption(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "momsbestpicture"
+	if _, err := s.Write(id, key, bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Verify(id, key); err != nil {
+		t.Errorf("expected a freshly written object to verify, have %s", err)
+	}
+
+	// Flip a bit on disk behind the back of the store.
+	path := fmt.Sprintf("%s/%s/%s", s.Root, id, s.PathTransformFunc(key).FullPath())
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0x01
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.(io.Closer).Close()
+
+	_, err = io.ReadAll(r)
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("expected a corruption error, have %v", err)
+	}
+	if corruption.Key != key {
+		t.Errorf("want corrupted key %s have %s", key, corruption.Key)
+	}
+}
+
+func TestStoreDiscardsPartialWrites(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "momsbestpicture"
+	data := []byte("some jpg bytes")
+	if _, err := s.Write(id, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write that fails halfway leaves the old object alone.
+	failing := io.MultiReader(bytes.NewReader([]byte("some other")), iotest.ErrReader(errors.New("connection reset")))
+	if _, err := s.Write(id, key, failing); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s (%v)", data, b, err)
+	}
+
+	// A truncated encrypted stream leaves nothing behind.
+	encKey := newEncryptionKey()
+	encrypted := new(bytes.Buffer)
+	if _, err := copyEncrypt(encKey, bytes.NewReader(make([]byte, 200*1024)), encrypted); err != nil {
+		t.Fatal(err)
+	}
+	truncated := bytes.NewReader(encrypted.Bytes()[:encrypted.Len()-4096])
+	if _, err := s.WriteDecrypt(encKey, id, "truncated", truncated); err == nil {
+		t.Fatal("expected the truncated stream to fail")
+	}
+	if s.Has(id, "truncated") {
+		t.Errorf("expected the truncated stream to leave nothing on disk")
+	}
+
+	// An object written before checksums has no sidecar and is served as it is.
+	if err := os.Remove(s.metaPath(id, key)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(id, key); err != nil {
+		t.Errorf("expected an object without a checksum to pass verification: %s", err)
+	}
+	_, r, err = s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(r)
+	r.(io.Closer).Close()
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("want %s have %s (%v)", data, b, err)
+	}
+}
+
+func TestStoreTombstones(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "momsbestpicture"
+	deleted := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	if ok := s.HasTombstone(id, key); ok {
+		t.Errorf("expected to NOT have a tombstone for %s", key)
+	}
+
+	if err := s.Tombstone(id, key, deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok := s.HasTombstone(id, key); !ok {
+		t.Errorf("expected to have a tombstone for %s", key)
+	}
+
+	tombstones, err := s.Tombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tombstones) != 1 {
+		t.Fatalf("want 1 tombstone have %d", len(tombstones))
+	}
+	if ts := tombstones[0]; ts.ID != id || ts.Key != key || !ts.Deleted.Equal(deleted) {
+		t.Errorf("unexpected tombstone %+v", ts)
+	}
+
+	if err := s.ClearTombstone(id, key); err != nil {
+		t.Error(err)
+	}
+
+	if ok := s.HasTombstone(id, key); ok {
+		t.Errorf("expected to NOT have a tombstone for %s after clearing it", key)
+	}
+	if written, ok := s.LastWrite(id, key); !ok || !written.After(deleted) {
+		t.Errorf("expected the write of %s after the delete to be recorded, have %s", key, written)
+	}
+
+	other := "otherpicture"
+	if err := s.Tombstone(id, other, deleted); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.ExpireTombstones(deleted.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || s.HasTombstone(id, other) {
+		t.Errorf("expected the tombstone of %s to expire, %d expired", other, n)
+	}
+	if _, ok := s.LastWrite(id, key); !ok {
+		t.Errorf("expected the recent write of %s to be kept", key)
+	}
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
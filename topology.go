@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	defaultZone = "default-zone"
+	defaultRack = "default-rack"
+)
+
+// Topology is the failure domain of a node: a zone holds racks, which hold
+// hosts. Nodes that share a rack go down together when the rack loses power
+// or its switch, nodes that share a zone when the zone does.
+type Topology struct {
+	Zone string
+	Rack string
+	Host string
+}
+
+// Location returns the topology as a path, /zone/rack/host, which is how it
+// is advertised to the other nodes. Missing parts are left empty.
+func (t Topology) Location() string {
+	if t == (Topology{}) {
+		return ""
+	}
+	return "/" + t.Zone + "/" + t.Rack + "/" + t.Host
+}
+
+// ParseLocation parses a location as returned by Topology.Location.
+func ParseLocation(location string) Topology {
+	parts := strings.SplitN(strings.TrimPrefix(location, "/"), "/", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return Topology{Zone: parts[0], Rack: parts[1], Host: parts[2]}
+}
+
+// topology returns the topology the node advertised. Nodes that did not
+// advertise a zone or rack are all in the default one, and every node is its
+// own host unless told otherwise.
+func (s *FileServer) topology(id string) Topology {
+	t := s.Topology
+	if id != s.ID {
+		t = ParseLocation(s.members.location(id))
+	}
+
+	if len(t.Zone) == 0 {
+		t.Zone = defaultZone
+	}
+	if len(t.Rack) == 0 {
+		t.Rack = defaultRack
+	}
+	if len(t.Host) == 0 {
+		t.Host = id
+	}
+	return t
+}
+
+// spread picks n of the nodes, which are ranked by the placement policy, so
+// that the replicas span as many failure domains as possible next to the ones
+// on the nodes already placed. Every pick prefers a zone that holds no replica
+// yet, then a rack, then a host, and the ranking breaks ties. When there are
+// fewer domains than replicas they are shared, evenly as far as the ranking
+// allows, so the replication factor is still met.
+func spread(ranked []string, placed []string, topology func(id string) Topology, n int) []string {
+	zones := make(map[string]int)
+	racks := make(map[string]int)
+	hosts := make(map[string]int)
+	add := func(id string) {
+		t := topology(id)
+		zones[t.Zone]++
+		racks[t.Zone+"/"+t.Rack]++
+		hosts[t.Zone+"/"+t.Rack+"/"+t.Host]++
+	}
+	for _, id := range placed {
+		add(id)
+	}
+
+	// Lower is better: the number of replicas already in the zone, rack and
+	// host of the node, in that order of importance.
+	score := func(id string) [3]int {
+		t := topology(id)
+		return [3]int{zones[t.Zone], racks[t.Zone+"/"+t.Rack], hosts[t.Zone+"/"+t.Rack+"/"+t.Host]}
+	}
+	less := func(a, b [3]int) bool {
+		for i := range a {
+			if a[i] != b[i] {
+				return a[i] < b[i]
+			}
+		}
+		return false
+	}
+
+	left := make([]string, len(ranked))
+	copy(left, ranked)
+
+	picked := []string{}
+	for len(picked) < n && len(left) > 0 {
+		best := 0
+		for i := 1; i < len(left); i++ {
+			if less(score(left[i]), score(left[best])) {
+				best = i
+			}
+		}
+
+		picked = append(picked, left[best])
+		add(left[best])
+		left = append(left[:best], left[best+1:]...)
+	}
+
+	return picked
+}
+
+// place picks n of the candidates for replicas of the (hashed) key: they are
+// ranked by PlacementFunc and then spread across failure domains, away from
+// the nodes that hold the key already.
+func (s *FileServer) place(key string, candidates []string, placed []string, n int) []string {
+	ranked := s.PlacementFunc(key, candidates, len(candidates))
+	return spread(ranked, placed, s.topology, n)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	topo := Topology{Zone: "eu-1", Rack: "r7", Host: "h3"}
+	if have := ParseLocation(topo.Location()); have != topo {
+		t.Errorf("want %+v have %+v", topo, have)
+	}
+
+	if have := ParseLocation("/eu-1"); have != (Topology{Zone: "eu-1"}) {
+		t.Errorf("unexpected topology %+v", have)
+	}
+	if loc := (Topology{}).Location(); len(loc) != 0 {
+		t.Errorf("want no location have %s", loc)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	topologies := map[string]Topology{
+		"a1": {Zone: "z1", Rack: "a", Host: "a1"},
+		"a2": {Zone: "z1", Rack: "a", Host: "a2"},
+		"b1": {Zone: "z1", Rack: "b", Host: "b1"},
+		"b2": {Zone: "z1", Rack: "b", Host: "b2"},
+		"c1": {Zone: "z2", Rack: "c", Host: "c1"},
+	}
+	topology := func(id string) Topology { return topologies[id] }
+
+	// The other zone first, then the rack of z1 that holds no replica yet.
+	if have := spread([]string{"a2", "b1", "b2", "c1"}, []string{"a1"}, topology, 2); !slices.Equal(have, []string{"c1", "b1"}) {
+		t.Errorf("unexpected placement %v", have)
+	}
+
+	// Within the same domains the ranking decides.
+	if have := spread([]string{"b2", "b1"}, nil, topology, 1); !slices.Equal(have, []string{"b2"}) {
+		t.Errorf("unexpected placement %v", have)
+	}
+
+	// Too few racks still meet the replication factor.
+	if have := spread([]string{"a1", "a2", "b1"}, []string{"b2"}, topology, 3); !slices.Equal(have, []string{"a1", "a2", "b1"}) {
+		t.Errorf("unexpected placement %v", have)
+	}
+	if have := spread([]string{"a1"}, nil, topology, 3); len(have) != 1 {
+		t.Errorf("want 1 node have %v", have)
+	}
+}
+
+func TestFileServerSpreadsAcrossRacks(t *testing.T) {
+	racks := map[string]string{
+		":6145": "rack-a",
+		":6245": "rack-a",
+		":6345": "rack-b",
+		":6445": "rack-c",
+		":6545": "rack-a",
+	}
+	servers := startTestCluster(t, func(s *FileServer) {
+		s.ReplicationFactor = 2
+		s.WriteQuorum = 2
+		s.Topology = Topology{Zone: "zone-1", Rack: racks[s.Transport.Addr()]}
+	}, ":6145", ":6245", ":6345", ":6445", ":6545")
+	meta, owner := servers[0], servers[4]
+
+	if have := owner.topology(servers[2].ID); have.Rack != "rack-b" || have.Host != servers[2].ID {
+		t.Fatalf("unexpected topology %+v", have)
+	}
+
+	// The owner keeps a copy on rack-a, so the replicas go to the other two
+	// racks, whichever nodes the ring ranks first.
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("picture_%d.png", i)
+		if err := owner.Store(key, bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Fatal(err)
+		}
+
+		holders := meta.metadata.Locate(owner.ID, hashKey(blockKey(key, 0)))
+		want := []string{servers[2].ID, servers[3].ID}
+		slices.Sort(want)
+		if !slices.Equal(holders, want) {
+			t.Errorf("want (%s) on rack-b and rack-c have %v", key, holders)
+		}
+	}
+}